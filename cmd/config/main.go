@@ -25,7 +25,7 @@ var (
 	cfgGet            = cfg.MustCommand("get", "get the current value of an option").Skip("locations")
 	optionGetKey      = cfgGet.NewString("option", "the option that should be get, if not set, all options that are set are returned", config.Shortflag('o'))
 	cfgPath           = cfg.MustCommand("path", "show the paths for the configuration files").Skip("locations")
-	optionPathType    = cfgPath.NewString("type", "the type of the config path. valid values are global,user,local and all", config.Shortflag('t'), config.Default("all"))
+	optionPathType    = cfgPath.NewString("type", "the type of the config path. valid values are global,user,runtime,local,all and loaded (the files that contribute to the current config)", config.Shortflag('t'), config.Default("all"))
 )
 
 func GetVersion(cmdpath string) (string, error) {
@@ -49,6 +49,7 @@ func GetSpec(cmdpath string, c *config.Config) error {
 		return fmt.Errorf("%s does not seem to be compatible with config", cmdpath)
 		// return err
 	}
+	// registers the shortflags and alternative names too
 	return c.UnmarshalJSON(out)
 }
 
@@ -69,8 +70,10 @@ func cmdPrintAll() error {
 		}
 		locations := map[string][]string{}
 
-		cmdConfig.EachValue(func(name string, value interface{}) {
-			locations[name] = cmdConfig.Locations(name)
+		cmdConfig.Each(func(name string, opt *config.Option, value interface{}, isSet bool) {
+			if isSet {
+				locations[name] = cmdConfig.Locations(name)
+			}
 		})
 
 		var b []byte
@@ -123,12 +126,8 @@ func main() {
 			os.Exit(1)
 		}
 		if !optionGetKey.IsSet() {
-			var vals = map[string]interface{}{}
-			cmdConfig.EachValue(func(name string, value interface{}) {
-				vals[name] = value
-			})
 			var b []byte
-			b, err = json.Marshal(vals)
+			b, err = cmdConfig.TreeJSON()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Can't print locations for program %s: %s", cmd, err.Error())
 				os.Exit(1)
@@ -143,15 +142,22 @@ func main() {
 				os.Exit(1)
 			}
 
-			val := cmdConfig.GetValue(key)
-			// cmdConfig.
-			fmt.Fprintf(os.Stdout, "%v\n", val)
+			b, err := cmdConfig.MarshalValueJSON(key)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Can't print value of option %s for program %s: %s", key, cmd, err.Error())
+				os.Exit(1)
+			}
+			fmt.Fprintln(os.Stdout, string(b))
 		}
 
 	case cfgSet:
 		key := optionSetKey.Get()
 		val := optionSetValue.Get()
 		ty := optionSetPathType.Get()
+		if err := cmdConfig.ValidateOptionValue(key, val); err != nil {
+			fmt.Fprintf(os.Stderr, "Can't set option %#v to value %#v: %s", key, val, err.Error())
+			os.Exit(1)
+		}
 		switch ty {
 		case "user":
 			if err := cmdConfig.LoadUser(); err != nil {
@@ -203,6 +209,9 @@ func main() {
 		case "user":
 			fmt.Fprintln(os.Stdout, cmdConfig.UserFile())
 			os.Exit(0)
+		case "runtime":
+			fmt.Fprintln(os.Stdout, cmdConfig.RuntimeFile())
+			os.Exit(0)
 		case "local":
 			fmt.Fprintln(os.Stdout, cmdConfig.LocalFile())
 			os.Exit(0)
@@ -210,10 +219,16 @@ func main() {
 			fmt.Fprintln(os.Stdout, cmdConfig.FirstGlobalsFile())
 			os.Exit(0)
 		case "all":
-			paths := map[string]string{
-				"user":   cmdConfig.UserFile(),
-				"local":  cmdConfig.LocalFile(),
-				"global": cmdConfig.FirstGlobalsFile(),
+			type path struct {
+				Path   string `json:"path"`
+				Exists bool   `json:"exists"`
+			}
+			status := cmdConfig.FileStatus()
+			paths := map[string]path{
+				"user":    {cmdConfig.SourceFile(config.SourceUser), status["user"]},
+				"runtime": {cmdConfig.SourceFile(config.SourceRuntime), status["runtime"]},
+				"local":   {cmdConfig.SourceFile(config.SourceLocals), status["local"]},
+				"global":  {cmdConfig.SourceFile(config.SourceGlobals), status["global"]},
 			}
 			b, err := json.Marshal(paths)
 			if err != nil {
@@ -221,10 +236,24 @@ func main() {
 				os.Exit(1)
 			}
 
+			fmt.Fprintln(os.Stdout, string(b))
+			os.Exit(0)
+		case "loaded":
+			err := cmdConfig.Load(false)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Can't load config options for program %s: %s", cmd, err.Error())
+				os.Exit(1)
+			}
+			b, err := json.Marshal(cmdConfig.LoadedFiles())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Can't print loaded files for program %s: %s", cmd, err.Error())
+				os.Exit(1)
+			}
+
 			fmt.Fprintln(os.Stdout, string(b))
 			os.Exit(0)
 		default:
-			fmt.Fprintf(os.Stderr, "'%s' is not a valid value for type option. possible values are 'local', 'global' or 'user'", ty)
+			fmt.Fprintf(os.Stderr, "'%s' is not a valid value for type option. possible values are 'local', 'global', 'user', 'all' or 'loaded'", ty)
 			os.Exit(1)
 		}
 	// some not allowed subcommand, should already be catched by config.Run
@@ -258,8 +287,9 @@ config [binary] -h                         // prints help about all options
 config [binary] -m key1=value1,key2=value2 // merges the options with global/user/local ones and prints the result
 
 each setting of an option is checked for validity of the type.
-for json values it is only checked, if it is valid json. additional
-checks for the json structure must be done by the binary
+for json values it is only checked, if it is valid json and conforms to the
+json schema of the option, if there is any. additional checks for the json
+structure must be done by the binary
 
 values are passed the following way:
 boolean values: true|false
@@ -3,15 +3,20 @@ package config
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
 	"strings"
 	"time"
 
@@ -34,9 +39,66 @@ type Config struct {
 	values    map[string]interface{}
 	locations map[string][]string
 	// maps shortflag to option
-	shortflags    map[string]string
+	shortflags map[string]string
+	// maps position to option
+	positions map[int]string
+	// maps alternative name to option
+	altnames map[string]string
+	// maps option to its transformation function
+	transforms    map[string]func(interface{}) (interface{}, error)
 	commands      map[string]*Config
 	activeCommand *Config
+	// args parsed by the last Load and args that are left over (after --)
+	consumedArgs  []string
+	remainingArgs []string
+	// options set via args
+	argsSet []string
+	// options set explicitly via config files, env variables, args or Set, see inheritValues
+	explicitSet map[string]bool
+	// config files merged since the last Reset
+	loadedFiles []string
+	// values of config files that have been skipped, see SetLenientValues
+	skippedValues []SkippedValue
+	// invalid values are collected instead of failing, see --config-validate
+	validating    bool
+	invalidValues []validationError
+
+	// filesystem of the config files, see SetFileSystem
+	fsys FileSystem
+	// file extension of the config files, if empty CONFIG_EXT is used
+	ext string
+	// environment of the app, see SetEnvironment
+	environment string
+	// commandline args, see SetArgs
+	args []string
+	// env variables, see SetEnv
+	env []string
+	// resolve references to other options, see SetInterpolation
+	interpolation bool
+	// resolve references to keys inside config files, see SetFileReferences
+	fileRefs bool
+	// options that are inherited by the commands, see InheritToSubs
+	inherited  map[string]bool
+	inheritAll bool
+	// extra metadata of the build, see SetBuildInfo
+	buildInfo map[string]string
+	// disabled introspection flags, see SetIntrospectionFlags
+	disabledFlags map[string]bool
+	// search for the local config file in parent directories
+	searchParents bool
+	// skip global, user and local config files that can't be merged
+	lenientFiles bool
+	// skip invalid values of config files, see SetLenientValues
+	lenientValues bool
+	// handling of unknown keys inside config files, see SetStrictFiles
+	strictFiles *bool
+	// comment after the first line of config files, see SetFileHeader
+	fileHeader *string
+	// order of the sources, see SetPrecedence
+	precedence []Source
+	// config file with defaults inside a fs, see SetDefaultsFS
+	defaultsFS     fs.FS
+	defaultsFSPath string
 
 	// only for subcommands
 	skippedOptions map[string]bool
@@ -45,7 +107,6 @@ type Config struct {
 }
 
 var leftWidth = 32
-var totalWidth = 80
 
 func pad(left string, right string) string {
 	var bf bytes.Buffer
@@ -57,41 +118,8 @@ func pad(left string, right string) string {
 		bf.WriteString(" ")
 	}
 
-	spaceRight := totalWidth - 1 - leftWidth
-	right = strings.Replace(right, "\n", " \n ", -1)
-	// fmt.Printf("%#v\n", right)
-	arr := strings.Split(right, " ")
-
-	spaceRightAvailable := spaceRight
-	for _, word := range arr {
-		w := strings.TrimSpace(word)
-		if w == "" && word != "\n" {
-			continue
-		}
-		// fmt.Printf("%#v\n", word)
-		// fmt.Printf(" w[0]: %#v \\n: %#v\n", w[0], '\n')
-		if len(w) > spaceRightAvailable || word == "\n" {
-			bf.WriteString("\n")
-			for i := 0; i < leftWidth; i++ {
-				bf.WriteString(" ")
-			}
-			spaceRightAvailable = spaceRight
-		}
-
-		bf.WriteString(w + " ")
-		spaceRightAvailable -= len(w) + 1
-	}
-
-	/*
-		for i, r := range right {
-			if i != 0 && i%spaceRight == 0 {
-				bf.WriteString("\n                           ")
-			}
-			bf.WriteRune(r)
-			// fmt.Printf("spaceRight: %v, i+1= %v\n", spaceRight, i+1)
-
-		}
-	*/
+	indent := strings.Repeat(" ", leftWidth)
+	bf.WriteString(strings.Join(wrap(right, terminalHelpWidth()-1-leftWidth), "\n"+indent))
 	return bf.String()
 }
 
@@ -116,6 +144,9 @@ func New(app string, version string, helpIntro string) (c *Config, err error) {
 	c.app = app
 	c.version = version
 	c.shortflags = map[string]string{}
+	c.positions = map[int]string{}
+	c.altnames = map[string]string{}
+	c.transforms = map[string]func(interface{}) (interface{}, error){}
 	c.helpIntro = helpIntro
 
 	c.Reset()
@@ -143,6 +174,106 @@ func (c *Config) EachValue(fn func(name string, val interface{})) {
 	}
 }
 
+// Each calls fn for each option of the config, sorted by name, with the spec of the
+// option, its current value and if it is set.
+func (c *Config) Each(fn func(name string, opt *Option, value interface{}, isSet bool)) {
+	names := make([]string, 0, len(c.spec))
+	for name := range c.spec {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		val, isSet := c.values[name]
+		fn(name, c.spec[name], val, isSet)
+	}
+}
+
+// NamedValue is the value of an option together with the name of the option
+type NamedValue struct {
+	Name  string
+	Value interface{}
+}
+
+// Values returns a snapshot of the values of the config, sorted by option name
+func (c *Config) Values() []NamedValue {
+	vals := make([]NamedValue, 0, len(c.values))
+	for k, val := range c.values {
+		vals = append(vals, NamedValue{k, val})
+	}
+	sort.Slice(vals, func(i, j int) bool {
+		return vals[i].Name < vals[j].Name
+	})
+	return vals
+}
+
+// Hash returns a hex encoded SHA-256 hash over the current values of the config
+// and its commands. It only depends on the effective values and their types,
+// not on the order in which they were set or on their locations, so it may be
+// used to detect whether the config changed between runs or reloads.
+func (c *Config) Hash() string {
+	h := sha256.New()
+	c.writeHash(h)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeHash writes the sorted values of the config and its commands to w
+func (c *Config) writeHash(w io.Writer) {
+	for _, v := range c.Values() {
+		if v.Value == nil {
+			continue
+		}
+		typ := ""
+		if spec, has := c.spec[v.Name]; has {
+			typ = spec.Type
+		}
+		bt, err := json.Marshal(c.jsonValue(v.Name, v.Value))
+		if err != nil {
+			bt = []byte(fmt.Sprintf("%#v", v.Value))
+		}
+		fmt.Fprintf(w, "%s\x00%s\x00%s\x00%s\n", c.commandName(), v.Name, typ, bt)
+	}
+	c.EachSubSorted(func(name string, sub *Config) {
+		sub.writeHash(w)
+	})
+}
+
+// EachSub calls fn for each command of the config in no particular order
+func (c *Config) EachSub(fn func(name string, sub *Config)) {
+	for name, sub := range c.commands {
+		fn(name, sub)
+	}
+}
+
+// EachSubSorted calls fn for each command of the config, sorted by name
+func (c *Config) EachSubSorted(fn func(name string, sub *Config)) {
+	for _, name := range c.commandNames() {
+		fn(name, c.commands[name])
+	}
+}
+
+// Walk calls fn for the config and then for each of its commands (sorted by name),
+// with the path of command names that leads to the visited config (empty for the root).
+func (c *Config) Walk(fn func(path []string, c *Config)) {
+	c.walk(nil, fn)
+}
+
+func (c *Config) walk(path []string, fn func(path []string, c *Config)) {
+	fn(path, c)
+	c.EachSubSorted(func(name string, sub *Config) {
+		sub.walk(append(append([]string{}, path...), name), fn)
+	})
+}
+
+// commandNames returns the sorted names of the commands
+func (c *Config) commandNames() []string {
+	names := make([]string, 0, len(c.commands))
+	for name := range c.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 /*
 TODO
 create this function to allow an option to be the last argument that is passed
@@ -188,8 +319,68 @@ func (c *Config) Relax(option string) *Config {
 	return c
 }
 
+// InheritToSubs makes the given options of the app inherited by its commands, or all
+// options, if no option is given. Options of the app are visible inside commands anyway
+// (unless skipped, see Skip), but a command that declares an option of the same name
+// (e.g. with another help text or default) would hide the value of the app.
+// For inherited options, such an option of the active command gets the value of the
+// app's option during Load, unless the command's option has been set explicitly
+// (via its config file key, env variable or commandline arg): so the precedence is
+// explicit value of the command > value of the app > default of the command.
+// The types of both options must be the same.
+// InheritToSubs panics, if it is called on a command or for an unknown option and is chainable.
+func (c *Config) InheritToSubs(optionNames ...string) *Config {
+	if c.isCommand() {
+		panic("can't InheritToSubs in subcommands")
+	}
+	if len(optionNames) == 0 {
+		c.inheritAll = true
+		return c
+	}
+	if c.inherited == nil {
+		c.inherited = map[string]bool{}
+	}
+	for _, option := range optionNames {
+		if _, has := c.spec[option]; !has {
+			panic("option " + option + " is not a general option")
+		}
+		c.inherited[option] = true
+	}
+	return c
+}
+
+// inheritValues sets the options of the command sub that are inherited from the app
+// (see InheritToSubs) to the values of the app, if they have not been set explicitly
+func (c *Config) inheritValues(sub *Config) error {
+	for name, subOpt := range sub.spec {
+		if !c.inheritAll && !c.inherited[name] {
+			continue
+		}
+		opt, has := c.spec[name]
+		if !has {
+			continue
+		}
+		if subOpt.Type != opt.Type {
+			return CommandError{sub.commandName(), InvalidTypeError{name, subOpt.Type}}
+		}
+		v, has := c.values[name]
+		if !has {
+			continue
+		}
+		if sub.explicitSet[name] {
+			continue
+		}
+		sub.values[name] = v
+		if locs := c.locations[name]; len(locs) > 0 {
+			sub.locations[name] = append(sub.locations[name], locs[len(locs)-1])
+		}
+	}
+	return nil
+}
+
 // Sub returns a *Config for a subcommand.
-// If name does not match to NameRegExp, an error is returned
+// If name does not match to NameRegExp, an error is returned, so command names are
+// always lowercase. On the commandline, they are matched case-insensitive.
 func (c *Config) Command(name string, helpIntro string) (s *Config, err error) {
 	if c.isCommand() {
 		err = ErrCommandCommand
@@ -209,6 +400,12 @@ func (c *Config) Command(name string, helpIntro string) (s *Config, err error) {
 	return s, nil
 }
 
+// lookupCommand returns the command for the given commandline arg, ignoring the case
+func (c *Config) lookupCommand(arg string) (sub *Config, has bool) {
+	sub, has = c.commands[strings.ToLower(arg)]
+	return
+}
+
 // addOption adds the given option, validates it and returns any error
 func (c *Config) addOption(opt *Option) error {
 	if err := ValidateName(opt.Name); err != nil {
@@ -218,30 +415,80 @@ func (c *Config) addOption(opt *Option) error {
 	if _, has := c.spec[opt.Name]; has {
 		return ErrDoubleOption(opt.Name)
 	}
+	if _, has := c.altnames[opt.Name]; has {
+		return ErrDoubleOption(opt.Name)
+	}
+	for _, alt := range opt.AltNames {
+		if err := ValidateName(alt); err != nil {
+			return ErrInvalidOptionName(alt)
+		}
+		_, isOption := c.spec[alt]
+		_, isAlt := c.altnames[alt]
+		if isOption || isAlt || alt == opt.Name {
+			return ErrDoubleOption(alt)
+		}
+	}
 	c.spec[opt.Name] = opt
+	for _, alt := range opt.AltNames {
+		c.altnames[alt] = opt.Name
+	}
 	if opt.Shortflag != "" {
-		if _, has := c.shortflags[opt.Shortflag]; has {
+		if c.hasShortflag(opt.Shortflag) {
 			return ErrDoubleShortflag(opt.Shortflag)
 		}
 		c.shortflags[opt.Shortflag] = opt.Name
 	}
+	if opt.Position > 0 {
+		if _, has := c.positions[opt.Position]; has {
+			return ErrDoublePosition(opt.Position)
+		}
+		c.positions[opt.Position] = opt.Name
+	}
 	return nil
 }
 
+// hasShortflag returns whether the shortflag is taken by the config, its parent or
+// any of its commands. Since the args of the app and of the active command are merged
+// together, a shortflag must be unique across them, so that it is always clear to which
+// option a shortflag on the commandline belongs. Different commands may share shortflags.
+func (c *Config) hasShortflag(flag string) bool {
+	if _, has := c.shortflags[flag]; has {
+		return true
+	}
+	if c.parent != nil {
+		_, has := c.parent.shortflags[flag]
+		return has
+	}
+	for _, sub := range c.commands {
+		if _, has := sub.shortflags[flag]; has {
+			return true
+		}
+	}
+	return false
+}
+
 // Reset cleans the values, the locations and any current subcommand
 func (c *Config) Reset() {
 	c.values = map[string]interface{}{}
 	c.locations = map[string][]string{}
 	c.activeCommand = nil
+	c.consumedArgs = nil
+	c.remainingArgs = nil
+	c.argsSet = nil
+	c.explicitSet = map[string]bool{}
+	c.loadedFiles = nil
+	c.skippedValues = nil
+	c.invalidValues = nil
 }
 
 // Location returns the locations where the option was set in the order of setting.
 //
 // The locations are tracked differently:
-// - defaults are tracked by their %v printed value
+// - defaults are tracked by "default " and their %v printed value, e.g. "default 42"
 // - environment variables are tracked by their name
 // - config files are tracked by their path
 // - cli args are tracked by their name
+// - positional cli args are tracked by their position, e.g. #1
 // - settings via Set() are tracked by the given location or the caller if that is empty
 func (c *Config) Locations(option string) []string {
 	if err := ValidateName(option); err != nil {
@@ -250,6 +497,51 @@ func (c *Config) Locations(option string) []string {
 	return c.locations[option]
 }
 
+// SourceOf returns the source of the current value of the option, based on
+// the last location (see Locations). If the option is not set, the empty
+// Source is returned.
+func (c *Config) SourceOf(option string) Source {
+	locs := c.Locations(option)
+	if len(locs) == 0 {
+		return ""
+	}
+	loc := locs[len(locs)-1]
+
+	return c.locationSource(loc)
+}
+
+// defaultLocation returns the location that tracks the given default value (see Locations)
+func defaultLocation(def interface{}) string {
+	return fmt.Sprintf("default %v", def)
+}
+
+// locationSource returns the source of the given location (see Locations)
+// or SourceOther, if it is unknown
+func (c *Config) locationSource(loc string) Source {
+	switch {
+	// checked first, since defaults may be negative numbers, e.g. "default -5"
+	case strings.HasPrefix(loc, "default "):
+		return SourceDefaults
+	case strings.HasPrefix(loc, envPrefix(c.app)):
+		return SourceEnv
+	case strings.HasPrefix(loc, "-"), strings.HasPrefix(loc, "#"):
+		return SourceArgs
+	case loc == c.UserFile():
+		return SourceUser
+	case RUNTIME_DIR != "" && loc == c.RuntimeFile():
+		return SourceRuntime
+	case loc == c.findLocalFile():
+		return SourceLocals
+	}
+
+	for _, dir := range splitGlobals() {
+		if loc == c.globalsFile(dir) {
+			return SourceGlobals
+		}
+	}
+	return SourceOther
+}
+
 // IsOption returns true, if the given option is allowed
 func (c *Config) IsOption(option string) bool {
 	if err := ValidateName(option); err != nil {
@@ -259,28 +551,122 @@ func (c *Config) IsOption(option string) bool {
 	return has
 }
 
-// set sets the option to the value and validates the value returning any errors
-func (c *Config) set(option string, value string, location string) error {
+// parseValue converts the value to the type of the option and validates it
+// against the option returning any errors
+func (c *Config) parseValue(option string, value string) (interface{}, error) {
 	if err := ValidateName(option); err != nil {
-		return InvalidNameError(option)
+		return nil, InvalidNameError(option)
 	}
 	spec, has := c.spec[option]
 
 	if !has {
-		return UnknownOptionError{c.version, option}
+		return nil, UnknownOptionError{c.version, option}
 	}
 
-	out, err := stringToValue(spec.Type, value)
+	var out interface{}
+	var err error
+
+	raw := value
+	if value, err = spec.expandPath(value, c.pathLookup); err != nil {
+		return nil, TransformError{option, raw, err}
+	}
+
+	for _, fn := range spec.Transforms {
+		if value, err = fn(value); err != nil {
+			return nil, TransformError{option, raw, err}
+		}
+	}
+
+	if spec.Type == "list" {
+		out = stringToList(value, spec.listSeparator())
+	} else if spec.Type == "json" && spec.RelaxedJSON {
+		out, err = relaxedJSON(value)
+	} else {
+		out, err = stringToValue(spec.Type, value)
+	}
 
 	if err != nil {
-		return InvalidValueError{option, value}
+		return nil, InvalidValueError{option, value}
+	}
+
+	if fn, has := c.transforms[option]; has {
+		out, err = fn(out)
+		if err != nil {
+			return nil, TransformError{option, value, err}
+		}
+	}
+
+	if err := spec.ValidateValue(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SetTransform sets a function that transforms the values of the given option after
+// they have been parsed and before they are stored, regardless of where they come from.
+// It can be used to normalize values, e.g. to trim or lowercase strings.
+// The returned value must have the type of the option.
+// SetTransform panics, if the option is unknown and is chainable.
+func (c *Config) SetTransform(option string, fn func(interface{}) (interface{}, error)) *Config {
+	if _, has := c.spec[option]; !has {
+		panic("option " + option + " is unknown")
+	}
+	c.transforms[option] = fn
+	return c
+}
+
+// ValidateOptionValue checks if the given value would be valid for the option
+// without setting it. It returns the same errors as Set would return.
+func (c *Config) ValidateOptionValue(option string, value string) error {
+	_, err := c.parseValue(option, value)
+	return err
+}
+
+// set sets the option to the value and validates the value returning any errors.
+// Since all sources (files, env and args) go through set, every value is validated
+// against the full option constraints before it is stored.
+func (c *Config) set(option string, value string, location string) error {
+	option = c.canonicalName(option)
+	out, err := c.parseValue(option, value)
+
+	if err != nil {
+		return c.collectInvalid(option, location, err)
 	}
 
 	c.values[option] = out
 	c.locations[option] = append(c.locations[option], location)
+	c.explicitSet[option] = true
 	return nil
 }
 
+// collectInvalid returns the given error of setting the option. If the app is validating
+// (see --config-validate), invalid values are collected by the app instead, so that all
+// of them can be reported, and nil is returned. Unknown options are always returned.
+func (c *Config) collectInvalid(option, location string, err error) error {
+	root := c
+	if c.parent != nil {
+		root = c.parent
+	}
+	switch err.(type) {
+	case UnknownOptionError, InvalidNameError:
+		return err
+	}
+	if !root.validating {
+		return err
+	}
+	root.invalidValues = append(root.invalidValues, validationError{c.commandName(), option, location, false, err.Error()})
+	return nil
+}
+
+// canonicalName returns the name of the option for the given alternative name.
+// Any other name is returned unchanged.
+func (c *Config) canonicalName(name string) string {
+	if opt, has := c.altnames[name]; has {
+		return opt
+	}
+	return name
+}
+
 // Set sets the option to the value. Location is a hint from where the
 // option setting was triggered. If the location is empty, the caller file
 // and line is tracked as location.
@@ -292,6 +678,43 @@ func (c *Config) Set(option string, val string, location string) error {
 	return c.set(option, val, location)
 }
 
+// SetValues sets the options to the given typed values (e.g. int32 for int32 options,
+// time.Time for date options and []string for lists) without parsing them from strings.
+// Transformations (see SetTransform) are applied. The values are validated before any
+// of them is set. If the location is empty, the caller file and line is tracked as location.
+func (c *Config) SetValues(vals map[string]interface{}, location string) error {
+	if location == "" {
+		_, file, line, _ := runtime.Caller(1)
+		location = fmt.Sprintf("%s:%d", file, line)
+	}
+
+	out := make(map[string]interface{}, len(vals))
+	for option, val := range vals {
+		option = c.canonicalName(option)
+		spec, has := c.spec[option]
+		if !has {
+			return UnknownOptionError{c.version, option}
+		}
+		if fn, has := c.transforms[option]; has {
+			var err error
+			if val, err = fn(val); err != nil {
+				return TransformError{option, val, err}
+			}
+		}
+		if err := spec.ValidateValue(val); err != nil {
+			return err
+		}
+		out[option] = val
+	}
+
+	for option, val := range out {
+		c.values[option] = val
+		c.locations[option] = append(c.locations[option], location)
+		c.explicitSet[option] = true
+	}
+	return nil
+}
+
 // setMap sets the given options and tracks the calling function as
 // location
 func (c *Config) setMap(options map[string]string) error {
@@ -312,10 +735,59 @@ func (c Config) IsSet(option string) bool {
 	if err := ValidateName(option); err != nil {
 		panic(InvalidNameError(option))
 	}
-	_, has := c.values[option]
+	_, has := c.value(option)
 	return has
 }
 
+// value returns the value of the option and if it is set.
+// Commands look up options they don't define themselves inside the parent
+// config (unless they are skipped), so that general options are visible from
+// inside the command.
+func (c *Config) value(option string) (v interface{}, has bool) {
+	v, has = c.values[option]
+	if has || c.parent == nil {
+		return
+	}
+	if _, own := c.spec[option]; own || c.skippedOptions[option] {
+		return
+	}
+	return c.parent.value(option)
+}
+
+// Has returns true, if the given option is known and has a value.
+// In contrast to IsSet, it does not panic for invalid option names, but returns false.
+func (c *Config) Has(option string) bool {
+	if err := ValidateName(option); err != nil {
+		return false
+	}
+	// values can only be set for known options
+	_, has := c.value(option)
+	return has
+}
+
+// IsDefault returns true, if the value of the given option has only been set by
+// LoadDefaults and has not been overwritten since.
+func (c *Config) IsDefault(option string) bool {
+	if err := ValidateName(option); err != nil {
+		panic(InvalidNameError(option))
+	}
+	spec, has := c.spec[option]
+	if !has || spec.Default == nil {
+		return false
+	}
+	locations := c.locations[option]
+	if len(locations) == 0 {
+		return false
+	}
+	def := defaultLocation(spec.Default)
+	for _, loc := range locations {
+		if loc != def {
+			return false
+		}
+	}
+	return true
+}
+
 // CheckMissing checks if mandatory values are missing inside the values map
 // CheckMissing stops on the first error
 func (c *Config) CheckMissing() error {
@@ -335,7 +807,7 @@ func (c *Config) checkMissing(skippedOptions map[string]bool, relaxedOptions map
 				continue
 			}
 			if _, has := c.values[k]; !has {
-				return MissingOptionError{c.version, k}
+				return MissingOptionError{c.version, k, spec.RequiredMessage}
 			}
 		}
 	}
@@ -362,11 +834,307 @@ func (c *Config) ValidateValues() error {
 	return nil
 }
 
+// ValidateAll is meant to be called after Load. It validates the values of the config
+// and of all of its commands and checks for missing mandatory values of the config
+// and of the active command, like --config-validate. Required options of the other
+// commands are not checked, since they only have to be set when the command is called.
+// ValidateAll stops on the first error. Errors of commands are returned as CommandError.
+func (c *Config) ValidateAll() error {
+	skipped := map[string]bool{}
+	relaxed := map[string]bool{}
+	if c.activeCommand != nil {
+		skipped = c.activeCommand.skippedOptions
+		relaxed = c.activeCommand.relaxedOptions
+	}
+
+	if err := c.checkMissing(skipped, relaxed); err != nil {
+		return err
+	}
+
+	if err := c.ValidateValues(); err != nil {
+		return err
+	}
+
+	for _, name := range c.commandNames() {
+		sub := c.commands[name]
+		if sub == c.activeCommand {
+			if err := sub.CheckMissing(); err != nil {
+				return CommandError{name, err}
+			}
+		}
+		if err := sub.ValidateValues(); err != nil {
+			return CommandError{name, err}
+		}
+	}
+	return nil
+}
+
+// validationError is an error of an option, reported by --config-validate
+type validationError struct {
+	Command string `json:"command,omitempty"`
+	Option  string `json:"option"`
+	// Location is the location of an invalid value that has not been set
+	Location string `json:"location,omitempty"`
+	Missing  bool   `json:"missing,omitempty"`
+	Error    string `json:"error"`
+}
+
+// validationErrors validates the values of the config and of all of its commands
+// and checks for missing mandatory values of the config and of the active command.
+// Unlike ValidateAll it does not stop on the first error. The invalid values that
+// have been collected while loading (see collectInvalid) are included.
+// The errors are sorted by command and option.
+func (c *Config) validationErrors() (errs []validationError) {
+	skipped := map[string]bool{}
+	relaxed := map[string]bool{}
+	if c.activeCommand != nil {
+		skipped = c.activeCommand.skippedOptions
+		relaxed = c.activeCommand.relaxedOptions
+	}
+
+	collect := func(command string, cfg *Config, checkMissing bool) {
+		names := make([]string, 0, len(cfg.spec))
+		for name := range cfg.spec {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			spec := cfg.spec[name]
+			v, has := cfg.values[name]
+			if !has {
+				if checkMissing && spec.Required && !skipped[name] && !relaxed[name] {
+					errs = append(errs, validationError{command, name, "", true, MissingOptionError{c.version, name, spec.RequiredMessage}.Error()})
+				}
+				continue
+			}
+			if v == nil {
+				continue
+			}
+			if err := spec.ValidateValue(v); err != nil {
+				errs = append(errs, validationError{command, name, "", false, err.Error()})
+			}
+		}
+	}
+
+	collect("", c, true)
+	// skipped and relaxed options only apply to the options of the app
+	skipped, relaxed = map[string]bool{}, map[string]bool{}
+	c.EachSubSorted(func(name string, sub *Config) {
+		collect(name, sub, sub == c.activeCommand)
+	})
+
+	errs = append(errs, c.invalidValues...)
+	sort.SliceStable(errs, func(a, b int) bool {
+		if errs[a].Command != errs[b].Command {
+			return errs[a].Command < errs[b].Command
+		}
+		return errs[a].Option < errs[b].Option
+	})
+	return
+}
+
+// traceEntry describes how the value of an option was resolved, see writeTrace
+type traceEntry struct {
+	Command   string      `json:"command,omitempty"`
+	Option    string      `json:"option"`
+	Type      string      `json:"type"`
+	Set       bool        `json:"set"`
+	Value     interface{} `json:"value"`
+	Locations []string    `json:"locations"`
+	Winner    string      `json:"winner,omitempty"`
+}
+
+// trace returns for every option of the config and of its commands the current
+// value and all the locations it was set at. The last location wins.
+// Values of secret options (see Secret) are masked, also inside the location of the default.
+func (c *Config) trace() (entries []traceEntry) {
+	collect := func(command string, cfg *Config) {
+		cfg.Each(func(name string, opt *Option, value interface{}, isSet bool) {
+			e := traceEntry{Command: command, Option: name, Type: opt.Type, Set: isSet, Locations: cfg.locations[name]}
+			if isSet {
+				e.Value = cfg.jsonValue(name, value)
+			}
+			if opt.Secret {
+				if isSet {
+					e.Value = "***"
+				}
+				locations := make([]string, len(e.Locations))
+				for i, loc := range e.Locations {
+					if opt.Default != nil && loc == defaultLocation(opt.Default) {
+						loc = defaultLocation("***")
+					}
+					locations[i] = loc
+				}
+				e.Locations = locations
+			}
+			if len(e.Locations) > 0 {
+				e.Winner = e.Locations[len(e.Locations)-1]
+			}
+			entries = append(entries, e)
+		})
+	}
+	collect("", c)
+	c.EachSubSorted(func(name string, sub *Config) {
+		collect(name, sub)
+	})
+	return
+}
+
+// writeTrace writes the trace of the config (see trace) either human readable or as JSON to w
+func (c *Config) writeTrace(w io.Writer, asJSON bool) error {
+	entries := c.trace()
+	if asJSON {
+		bt, err := json.Marshal(entries)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", bt)
+		return err
+	}
+
+	var bf bytes.Buffer
+	for _, e := range entries {
+		name := e.Option
+		if e.Command != "" {
+			name = e.Command + " " + name
+		}
+		if !e.Set {
+			fmt.Fprintf(&bf, "%s (%s) is not set\n", name, e.Type)
+			continue
+		}
+		val, err := json.Marshal(e.Value)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&bf, "%s (%s) = %s\n", name, e.Type, val)
+		for i, loc := range e.Locations {
+			if i == len(e.Locations)-1 {
+				fmt.Fprintf(&bf, "  %d. %s <- wins\n", i+1, loc)
+			} else {
+				fmt.Fprintf(&bf, "  %d. %s\n", i+1, loc)
+			}
+		}
+	}
+	_, err := w.Write(bf.Bytes())
+	return err
+}
+
+// printValidation prints the result of the validation as JSON and exits
+// with a nonzero exit code, if the config is not valid
+func (c *Config) printValidation() {
+	errs := c.validationErrors()
+	bt, err := json.Marshal(struct {
+		Valid  bool              `json:"valid"`
+		Errors []validationError `json:"errors"`
+	}{len(errs) == 0, errs})
+	if err != nil {
+		err2Stderr(err)
+	}
+	fmt.Fprintf(os.Stdout, "%s\n", bt)
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// PromptMissing asks for the values of the required options of the config and of the
+// active command that are not set (e.g. after Load). For each option, the help text and
+// the type are written to out and the value is read as a line from in. Invalid values
+// are asked for again. If in is a terminal, the input of secret options (see Secret)
+// is not echoed. The values are tracked with the location "prompt".
+func (c *Config) PromptMissing(in io.Reader, out io.Writer) error {
+	rd := bufio.NewReader(in)
+	skipped := map[string]bool{}
+	relaxed := map[string]bool{}
+	if c.activeCommand != nil {
+		skipped = c.activeCommand.skippedOptions
+		relaxed = c.activeCommand.relaxedOptions
+	}
+
+	prompt := func(cfg *Config) (err error) {
+		cfg.Each(func(name string, opt *Option, value interface{}, isSet bool) {
+			if err != nil || isSet || !opt.Required || skipped[name] || relaxed[name] {
+				return
+			}
+			err = cfg.promptOption(rd, in, out, opt)
+		})
+		return
+	}
+
+	if err := prompt(c); err != nil {
+		return err
+	}
+	if c.activeCommand != nil {
+		// skipped and relaxed options only apply to the options of the app
+		skipped, relaxed = map[string]bool{}, map[string]bool{}
+		return prompt(c.activeCommand)
+	}
+	return nil
+}
+
+// promptOption asks for the value of the given option until a valid value is entered
+func (c *Config) promptOption(rd *bufio.Reader, in io.Reader, out io.Writer, opt *Option) error {
+	for {
+		fmt.Fprintf(out, "%s\n%s (%s): ", opt.helpText(), opt.Name, opt.Type)
+
+		var restore func()
+		if f, isFile := in.(*os.File); isFile && opt.Secret {
+			restore, _ = disableEcho(f.Fd())
+		}
+		line, err := rd.ReadString('\n')
+		if restore != nil {
+			restore()
+			fmt.Fprintln(out)
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if err != nil {
+				return MissingOptionError{c.version, opt.Name, opt.RequiredMessage}
+			}
+			continue
+		}
+
+		if errSet := c.set(opt.Name, line, "prompt"); errSet != nil {
+			fmt.Fprintf(out, "invalid value: %s\n", errSet.Error())
+			if err != nil {
+				return errSet
+			}
+			continue
+		}
+		return nil
+	}
+}
+
 // CurrentSub returns the active command
 func (c *Config) ActiveCommand() (s *Config) {
 	return c.activeCommand
 }
 
+// SetActiveCommand sets the active command by name (case-insensitive, see Command),
+// without parsing any args, e.g. for tests. The empty name deactivates the active command.
+// The active command is reset by Reset and set by Load.
+func (c *Config) SetActiveCommand(name string) error {
+	if c.isCommand() {
+		return errors.New("SetActiveCommand must not be called in sub command")
+	}
+	if name == "" {
+		c.activeCommand = nil
+		return nil
+	}
+	sub, has := c.lookupCommand(name)
+	if !has {
+		return UnknownCommandError(name)
+	}
+	c.activeCommand = sub
+	return nil
+}
+
+// Parent returns the *Config the command belongs to or nil, if the *Config is no command
+func (c *Config) Parent() *Config {
+	return c.parent
+}
+
 // isCommand checks if the *Config relongs to a subcommand
 func (c *Config) isCommand() bool {
 	return !(strings.Index(c.app, "_") == -1)
@@ -377,9 +1145,121 @@ func (c *Config) MarshalJSON() ([]byte, error) {
 	return json.Marshal(c.spec)
 }
 
-// UnmarshalJSON deserializes the spec from JSON
+// SpecEqual checks if the options of the config have the same definitions as the options
+// of the other config. The names, types, defaults, requiredness, shortflags, positions and
+// list separators are compared, the help texts and the current values are ignored.
+func (c *Config) SpecEqual(other *Config) bool {
+	if len(c.spec) != len(other.spec) {
+		return false
+	}
+	for name, opt := range c.spec {
+		otherOpt, has := other.spec[name]
+		if !has || !opt.sameDefinition(otherOpt) {
+			return false
+		}
+	}
+	return true
+}
+
+// TreeJSON serializes the values of the config and the values of all of its commands
+// to JSON in the form
+//
+//	{"values": {"option": value, ...}, "commands": {"command": {"values": {...}}, ...}}
+//
+// Values of json options are embedded as JSON.
+func (c *Config) TreeJSON() ([]byte, error) {
+	return json.Marshal(c.tree())
+}
+
+type valueTree struct {
+	Values   map[string]interface{} `json:"values"`
+	Commands map[string]*valueTree  `json:"commands,omitempty"`
+}
+
+func (c *Config) tree() *valueTree {
+	t := &valueTree{Values: map[string]interface{}{}}
+	for k, v := range c.values {
+		t.Values[k] = c.jsonValue(k, v)
+	}
+	if len(c.commands) > 0 {
+		t.Commands = map[string]*valueTree{}
+		for name, sub := range c.commands {
+			t.Commands[name] = sub.tree()
+		}
+	}
+	return t
+}
+
+// jsonValue prepares the value of the option for the serialization to JSON:
+// values of json options are embedded as JSON and times are formatted like
+// inside config files
+func (c *Config) jsonValue(option string, v interface{}) interface{} {
+	spec, has := c.spec[option]
+	if !has {
+		return v
+	}
+	switch ty := v.(type) {
+	case string:
+		if spec.Type == "json" {
+			return json.RawMessage(ty)
+		}
+	case time.Time:
+		switch spec.Type {
+		case "date":
+			return ty.Format(DateFormat)
+		case "time":
+			return ty.Format(TimeFormat)
+		case "datetime":
+			return ty.Format(DateTimeFormat)
+		}
+	}
+	return v
+}
+
+// MarshalValueJSON serializes the value of the option together with its type
+// to JSON in the form
+//
+//	{"option": "start", "type": "date", "value": "2014-12-24"}
+//
+// Times are formatted like inside config files and values of json options are
+// embedded as JSON. If the option is not set, the value is null.
+func (c *Config) MarshalValueJSON(option string) ([]byte, error) {
+	spec, has := c.spec[option]
+	if !has {
+		return nil, UnknownOptionError{c.version, option}
+	}
+	var val interface{}
+	if v, has := c.value(option); has {
+		val = c.jsonValue(option, v)
+	}
+	return json.Marshal(struct {
+		Option string      `json:"option"`
+		Type   string      `json:"type"`
+		Value  interface{} `json:"value"`
+	}{option, spec.Type, val})
+}
+
+// UnmarshalJSON deserializes the spec from JSON. The defaults are converted to the
+// types of their options and the shortflags, positions and alternative names are registered.
 func (c *Config) UnmarshalJSON(data []byte) error {
-	return json.Unmarshal(data, &c.spec)
+	if err := json.Unmarshal(data, &c.spec); err != nil {
+		return err
+	}
+	for name, opt := range c.spec {
+		if err := opt.normalizeDefault(); err != nil {
+			return err
+		}
+		for _, alt := range opt.AltNames {
+			c.altnames[alt] = name
+		}
+		if opt.Shortflag != "" {
+			c.shortflags[opt.Shortflag] = name
+		}
+		if opt.Position > 0 {
+			c.positions[opt.Position] = name
+		}
+	}
+	return nil
 }
 
 // appName returns the name of the app
@@ -390,6 +1270,48 @@ func (c *Config) appName() string {
 	return c.app
 }
 
+// AppName returns the name of the app (also for commands)
+func (c *Config) AppName() string {
+	return c.appName()
+}
+
+// Version returns the version of the app
+func (c *Config) Version() string {
+	return c.version
+}
+
+// SetBuildInfo sets extra metadata of the build (e.g. commit and build date) that is
+// printed by the --version-json flag. The keys app, version and go are reserved and ignored.
+// SetBuildInfo is chainable.
+func (c *Config) SetBuildInfo(info map[string]string) *Config {
+	if c.parent != nil {
+		c.parent.SetBuildInfo(info)
+		return c
+	}
+	c.buildInfo = map[string]string{}
+	for k, v := range info {
+		c.buildInfo[k] = v
+	}
+	return c
+}
+
+// VersionJSON returns the JSON that is printed by the --version-json flag:
+// an object with the app name, the version, the go version and the build info (see SetBuildInfo).
+func (c *Config) VersionJSON() ([]byte, error) {
+	info := map[string]string{}
+	root := c
+	if c.parent != nil {
+		root = c.parent
+	}
+	for k, v := range root.buildInfo {
+		info[k] = v
+	}
+	info["app"] = c.appName()
+	info["version"] = c.version
+	info["go"] = runtime.Version()
+	return json.Marshal(info)
+}
+
 func (c *Config) CommmandName() string {
 	return c.commandName()
 }
@@ -407,83 +1329,186 @@ func (c *Config) Binary() (path string, err error) {
 	return exec.LookPath(c.appName())
 }
 
+// Merge merges the config file from rd into the config. The first line of the file
+// must be the header [app] [version]. If Merge is called on a command, the file is a
+// standalone file of the command with the header [app]_[command] [version] and the
+// options of the command without prefix.
 func (c *Config) Merge(rd io.Reader, location string) error {
 	wrapErr := func(err error) error {
 		return InvalidConfigFileError{location, c.version, err}
 	}
 
-	sc := bufio.NewScanner(rd)
-	if !sc.Scan() {
-		return wrapErr(errors.New("can't read config header (app and version)"))
-	}
-	header := sc.Text()
-	words := strings.Split(header, " ")
-	if len(words) != 2 {
-		return wrapErr(errors.New("invalid config header"))
-	}
-	if words[0] != c.appName() {
-		return wrapErr(fmt.Errorf("invalid config header: app is %#v but config is for app %#v", c.appName(), words[0]))
+	var fileVersion string
+
+	// standalone files of commands have the header [app]_[command] [version]
+	headerName := c.appName()
+	if c.isCommand() {
+		headerName = c.app
 	}
 
-	differentVersions := words[1] != c.version
+	header := func(app, version string) error {
+		if app != headerName {
+			return wrapErr(fmt.Errorf("invalid config header: expected %#v but config is for %#v", headerName+" "+c.version, app+" "+version))
+		}
+		fileVersion = version
+		return nil
+	}
 
-	var keys = map[string]bool{}
+	strict, strictSet := c.strictness()
+	lenient := strictSet && !strict
+	lenientValues := c.skipsInvalidValues()
 
-	var valBuf bytes.Buffer
-	var key string
-	var subcommand string
+	fileRefs := c.fileReferences()
+	// the (resolved) values of the file by key, see SetFileReferences
+	fileValues := map[string]string{}
 
-	setValue := func() error {
-		val := strings.TrimSpace(valBuf.String())
-		if val == "" {
+	setValue := func(subcommand, key, val string) error {
+		if fileRefs {
+			fullKey := key
 			if subcommand != "" {
-				key = subcommand + "_" + key
+				fullKey = subcommand + "_" + key
 			}
-			return EmptyValueError(key)
+			var err error
+			if val, err = resolveFileReferences(fullKey, val, fileValues); err != nil {
+				return wrapErr(err)
+			}
+			fileValues[fullKey] = val
 		}
-		// key := strings.TrimRight(key, " ")
+
 		var err error
 		if subcommand == "" {
 			//fmt.Printf("setting %#v to %#v\n", key, val)
 			err = c.set(key, val, location)
+
+			// unknown options of the app are ignored, unless files are strict
+			if _, unknown := err.(UnknownOptionError); unknown && !strict {
+				if lenient {
+					Warn(fmt.Sprintf("skipping unknown option %s in config file %s", key, location))
+				}
+				return nil
+			}
 		} else {
 			//fmt.Printf("setting %#v to %#v for subcommand %#v\n", key, val, subcommand)
 			sub, has := c.commands[subcommand]
 			if !has {
+				if lenient {
+					Warn(fmt.Sprintf("skipping option %s of unknown subcommand %s in config file %s", key, subcommand, location))
+					return nil
+				}
 				return errors.New("unknown subcommand " + subcommand)
 			} else {
 				err = sub.set(key, val, location)
+				if _, unknown := err.(UnknownOptionError); unknown && lenient {
+					Warn(fmt.Sprintf("skipping unknown option %s_%s in config file %s", subcommand, key, location))
+					return nil
+				}
 			}
+		}
 
-			if err != nil {
-				if differentVersions {
-					return wrapErr(fmt.Errorf("value %#v of option %s, present in config for version %s is not valid for running version %s",
-						val, key, words[1], c.version))
-				} else {
-					return wrapErr(err)
+		if err != nil {
+			if _, unknown := err.(UnknownOptionError); !unknown && lenientValues {
+				fullKey := key
+				if subcommand != "" {
+					fullKey = subcommand + "_" + key
+				}
+				skipped := SkippedValue{
+					Option:      fullKey,
+					Value:       val,
+					Location:    location,
+					FileVersion: fileVersion,
+					VersionSkew: fileVersion != c.version,
+					Err:         err,
+				}
+				// the skipped values are reported by the app, see LoadReport
+				root := c
+				if c.parent != nil {
+					root = c.parent
 				}
+				root.skippedValues = append(root.skippedValues, skipped)
+				Warn(fmt.Sprintf("skipping value %#v of option %s in config file %s: %s", val, fullKey, location, err.Error()))
+				return nil
+			}
+			if fileVersion != c.version {
+				return wrapErr(fmt.Errorf("value %#v of option %s, present in config for version %s is not valid for running version %s",
+					val, key, fileVersion, c.version))
+			} else {
+				return wrapErr(err)
 			}
 		}
 		return nil
 	}
 
+	err := parseConfig(rd, wrapErr, header, setValue)
+	if empty, is := err.(EmptyValueError); is {
+		return EmptyValueSourceError{empty, c.locationSource(location), location}
+	}
+	return err
+}
+
+// parseConfig parses a config file in the native format. The app and version of the
+// header are passed to header and every option with its (trimmed) value to setValue.
+// Options of subcommands are passed with the name of the subcommand, otherwise
+// subcommand is empty. Syntax errors of the header and options are wrapped by wrapErr.
+func parseConfig(rd io.Reader, wrapErr func(error) error, header func(app, version string) error, setValue func(subcommand, key, val string) error) error {
+	if err := ValidatePrefixes(); err != nil {
+		return err
+	}
+
+	sc := bufio.NewScanner(rd)
+	if !sc.Scan() {
+		return wrapErr(errors.New("can't read config header (app and version)"))
+	}
+	// some editors (e.g. on windows) prefix the file with a UTF-8 byte order mark
+	words := strings.Split(strings.TrimPrefix(sc.Text(), "\ufeff"), " ")
+	if len(words) != 2 {
+		return wrapErr(errors.New("invalid config header"))
+	}
+	if err := header(words[0], words[1]); err != nil {
+		return err
+	}
+
+	// the line numbers of the keys
+	var keys = map[string]int{}
+	var line = 1
+
+	var valBuf bytes.Buffer
+	var key string
+	var subcommand string
+
+	flush := func() error {
+		val := strings.TrimSpace(valBuf.String())
+		if val == "" {
+			if subcommand != "" {
+				return EmptyValueError(subcommand + "_" + key)
+			}
+			return EmptyValueError(key)
+		}
+		return setValue(subcommand, key, val)
+	}
+
 	for sc.Scan() {
+		line++
 
 		pair := sc.Text()
 		//fmt.Printf("pair: %#v\n", pair)
 
 		if len(pair) == 0 {
-			continue // Todo add a new line to existing values
+			// blank lines are part of the value of the current key
+			// (trailing blank lines are trimmed)
+			if key != "" {
+				valBuf.WriteString("\n")
+			}
+			continue
 		}
 
-		switch pair[:1] {
+		switch {
 		// comment
-		case "#":
+		case strings.HasPrefix(pair, COMMENT_PREFIX):
 			continue
 			// option
-		case "$":
+		case strings.HasPrefix(pair, OPTION_PREFIX):
 			if key != "" {
-				if err := setValue(); err != nil {
+				if err := flush(); err != nil {
 					return err
 				}
 			}
@@ -491,11 +1516,11 @@ func (c *Config) Merge(rd io.Reader, location string) error {
 			if idx == -1 {
 				return wrapErr(fmt.Errorf("missing '=' in %#v", pair))
 			}
-			key = strings.TrimRight(pair[1:idx], " ")
-			if _, has := keys[key]; has {
-				return ErrDoubleOption(key)
+			key = strings.TrimRight(pair[len(OPTION_PREFIX):idx], " ")
+			if first, has := keys[key]; has {
+				return wrapErr(DuplicateKeyError{key, line, first})
 			}
-			keys[key] = true
+			keys[key] = line
 			subcommand = ""
 
 			if underscPos := strings.Index(key, "_"); underscPos > 0 {
@@ -514,28 +1539,175 @@ func (c *Config) Merge(rd io.Reader, location string) error {
 					return err
 				}
 			}
-
-			// valueMode = true
-			valBuf.Reset()
-			if idx < len(pair)-2 {
-				valBuf.WriteString(pair[idx+1:])
+
+			// valueMode = true
+			valBuf.Reset()
+			if idx < len(pair)-1 {
+				valBuf.WriteString(pair[idx+1:])
+			}
+		default:
+			valBuf.WriteString("\n" + unescapeLine(pair))
+
+		}
+
+	}
+	if key != "" {
+		return flush()
+	}
+	return nil
+}
+
+// CheckFile parses the config file with the given path without a spec and returns the
+// app and version of the header and the keys of the options in the order of the file
+// (options of subcommands as [subcommand]_[option]). The values are not validated.
+// Syntax errors are returned as ConfigFileSyntaxError.
+// CheckFile is useful for tools that lint config files offline.
+func CheckFile(path string) (app, version string, keys []string, err error) {
+	file, err := OSFileSystem{}.Open(path)
+	if err != nil {
+		return "", "", nil, err
+	}
+	defer file.Close()
+
+	wrapErr := func(err error) error {
+		return ConfigFileSyntaxError{path, err}
+	}
+
+	header := func(a, v string) error {
+		if err := ValidateName(a); err != nil {
+			return wrapErr(fmt.Errorf("invalid app name %#v in config header", a))
+		}
+		if err := ValidateVersion(v); err != nil {
+			return wrapErr(fmt.Errorf("invalid version %#v in config header", v))
+		}
+		app, version = a, v
+		return nil
+	}
+
+	setValue := func(subcommand, key, val string) error {
+		if subcommand != "" {
+			key = subcommand + "_" + key
+		}
+		keys = append(keys, key)
+		return nil
+	}
+
+	if err = parseConfig(file, wrapErr, header, setValue); err != nil {
+		switch err.(type) {
+		case ConfigFileSyntaxError:
+		default:
+			err = ConfigFileSyntaxError{path, err}
+		}
+		return "", "", nil, err
+	}
+	return
+}
+
+// MergeJSON merges the configuration given as a single JSON object into the config,
+// e.g. {"name": "Mickey", "age": 42, "project": {"title": "Fantasia"}}. The keys are the
+// names of the options; options of commands are given inside an object under the name
+// of the command. Every value is parsed and validated like the values of config files,
+// values of json options may be any JSON value. Unknown keys are handled like inside
+// config files, see SetStrictFiles.
+func (c *Config) MergeJSON(rd io.Reader, location string) error {
+	wrapErr := func(err error) error {
+		return InvalidConfigFileError{location, c.version, err}
+	}
+	dec := json.NewDecoder(rd)
+	dec.UseNumber()
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return wrapErr(fmt.Errorf("invalid JSON object: %s", err.Error()))
+	}
+	if err := c.mergeJSON(obj, location); err != nil {
+		return wrapErr(err)
+	}
+	return nil
+}
+
+func (c *Config) mergeJSON(obj map[string]interface{}, location string) error {
+	strict, strictSet := c.strictness()
+
+	// sorted, to report the same error every time
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v := obj[key]
+		if sub, has := c.commands[key]; has {
+			if subObj, isObj := v.(map[string]interface{}); isObj {
+				if err := sub.mergeJSON(subObj, location); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		spec, has := c.spec[c.canonicalName(key)]
+		if !has {
+			switch {
+			case strict || (!strictSet && c.isCommand()):
+				return UnknownOptionError{c.version, key}
+			case strictSet:
+				Warn(fmt.Sprintf("skipping unknown option %s in %s", key, location))
+			}
+			continue
+		}
+
+		var val string
+		switch ty := v.(type) {
+		case string:
+			val = ty
+		case json.Number:
+			val = ty.String()
+		case bool:
+			val = fmt.Sprintf("%v", ty)
+		case []interface{}:
+			if spec.Type == "json" {
+				break
+			}
+			items := make([]string, len(ty))
+			for i, item := range ty {
+				items[i] = fmt.Sprintf("%v", item)
 			}
+			val = strings.Join(items, spec.listSeparator())
 		default:
-			valBuf.WriteString("\n" + pair)
+			if spec.Type != "json" {
+				return InvalidValueError{key, ty}
+			}
+		}
 
+		if spec.Type == "json" {
+			bt, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			val = string(bt)
 		}
 
-	}
-	if key != "" {
-		setValue()
+		if val == "" {
+			return EmptyValueSourceError{EmptyValueError(key), SourceOther, location}
+		}
+
+		if err := c.set(key, val, location); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// MergeEnv merges the environment variables of the config (see ENV and SetEnv) into the config.
+// The values are validated and any invalid value results in an InvalidConfigEnv error.
+// The env variables are named [APP]_CONFIG_[OPTION] in uppercase, e.g. the option
+// loglevel of the app myapp is set via MYAPP_CONFIG_LOGLEVEL. Since option names consist
+// of lowercase letters and digits only, the key is simply lowercased.
 func (c *Config) MergeEnv() error {
-	prefix := strings.ToUpper(c.app) + "_CONFIG_"
+	prefix := envPrefix(c.app)
 	// fmt.Printf("looking for prefix %#v\n", prefix)
-	for _, pair := range ENV {
+	for _, pair := range c.environ() {
 		if strings.HasPrefix(pair, prefix) {
 			// fmt.Printf("Env: %#v\n", pair)
 			startKey := len(prefix) // strings.Index(pair, prefix)
@@ -545,7 +1717,7 @@ func (c *Config) MergeEnv() error {
 				val = strings.TrimSpace(val)
 
 				if val == "" {
-					return EmptyValueError(key)
+					return EmptyValueSourceError{EmptyValueError(strings.ToLower(key)), SourceEnv, pair[:startVal]}
 				}
 				// fmt.Printf("key %#v val %#v\n", key, val)
 				err := c.set(strings.ToLower(key), val, pair[:startVal])
@@ -572,6 +1744,10 @@ func convertOpttype(optType string) string {
 		return "''"
 	case "json":
 		return "<json>"
+	case "list":
+		return "<list>"
+	case "binary":
+		return "<base64>"
 	case "time":
 		return "<hh:mm:ss>"
 	case "datetime":
@@ -610,10 +1786,158 @@ func (c *Config) MergeArgs() error {
 		skipped = c.skippedOptions
 		relaxed = c.relaxedOptions
 	}
-	_, err := c.mergeArgs(false, ARGS, skipped, relaxed)
+	args, rest := splitArgs(c.arguments())
+	c.consumedArgs = args
+	c.remainingArgs = rest
+	cfgs := []*Config{c}
+	if c.parent != nil {
+		cfgs = append(cfgs, c.parent)
+	}
+	_, err := c.mergeArgs(false, expandShortflags(args, cfgs...), skipped, relaxed)
 	return err
 }
 
+// expandShortflags expands clusters of shortflags of the given configs getopt-style,
+// e.g. -xvf archive.tar to -x -v -f=archive.tar: the shortflags of bool options are
+// taken until the first shortflag of another type. Its value is the rest of the cluster
+// or the following arg. Args that are no such clusters are returned unchanged, as well
+// as single dash args with the name of an option, e.g. -nocache.
+func expandShortflags(args []string, cfgs ...*Config) []string {
+	lookup := func(flag string) (*Option, bool) {
+		for _, c := range cfgs {
+			if name, has := c.shortflags[flag]; has {
+				return c.spec[name], true
+			}
+		}
+		return nil, false
+	}
+
+	isOption := func(name string) bool {
+		for _, c := range cfgs {
+			if _, has := c.spec[c.canonicalName(name)]; has {
+				return true
+			}
+		}
+		return false
+	}
+
+	out := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || strings.HasPrefix(arg, "--") || isNumber(arg) {
+			out = append(out, arg)
+			continue
+		}
+
+		cluster, val, hasVal := arg[1:], "", false
+		if idx := strings.Index(cluster, "="); idx != -1 {
+			cluster, val, hasVal = cluster[:idx], cluster[idx+1:], true
+		}
+		if len(cluster) < 2 || isOption(cluster) {
+			out = append(out, arg)
+			continue
+		}
+
+		var expanded []string
+		consumed := i
+		ok := true
+		hasValueFlag := false
+		for j := 0; j < len(cluster) && ok; j++ {
+			flag := cluster[j : j+1]
+			opt, has := lookup(flag)
+			if !has {
+				ok = false
+				break
+			}
+			if opt.Type == "bool" {
+				expanded = append(expanded, "-"+flag)
+				continue
+			}
+			hasValueFlag = true
+			rest := cluster[j+1:]
+			switch {
+			case rest != "" && !hasVal:
+				expanded = append(expanded, "-"+flag+"="+rest)
+			case rest == "" && hasVal:
+				expanded = append(expanded, "-"+flag+"="+val)
+			case rest == "" && consumed+1 < len(args):
+				consumed++
+				expanded = append(expanded, "-"+flag+"="+args[consumed])
+			default:
+				ok = false
+			}
+			break
+		}
+
+		if ok && !hasValueFlag && hasVal {
+			// e.g. -xv=false
+			expanded[len(expanded)-1] += "=" + val
+		}
+
+		if !ok {
+			out = append(out, arg)
+			continue
+		}
+		out = append(out, expanded...)
+		i = consumed
+	}
+	return out
+}
+
+// optionScopeError returns an OptionScopeError, if the given arg is no option of the
+// config, but an option of one of its commands (except the active one).
+// Otherwise nil is returned.
+func (c *Config) optionScopeError(arg string, active *Config) error {
+	flag := arg
+	if idx := strings.Index(flag, "="); idx != -1 {
+		flag = flag[:idx]
+	}
+	key := argToKey(flag)
+
+	for _, name := range c.commandNames() {
+		sub := c.commands[name]
+		if sub == active {
+			continue
+		}
+		opt := key
+		if sh, has := sub.shortflags[opt]; has {
+			opt = sh
+		}
+		if _, has := sub.spec[opt]; has {
+			return OptionScopeError{c.version, flag, name}
+		}
+	}
+	return nil
+}
+
+// splitArgs splits the args at the first "--". The args after it are not parsed.
+func splitArgs(args []string) (parse []string, rest []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		}
+	}
+	return args, nil
+}
+
+// ArgsSet returns the sorted names of the options that have been set via the
+// commandline by the last call of Load or MergeArgs
+func (c *Config) ArgsSet() []string {
+	return c.argsSet
+}
+
+// ConsumedArgs returns the commandline args that have been parsed by the last call
+// of Load or MergeArgs, including the name of the active command
+func (c *Config) ConsumedArgs() []string {
+	return c.consumedArgs
+}
+
+// RemainingArgs returns the commandline args following "--" that have not been parsed
+// by the last call of Load or MergeArgs, e.g. to forward them to another program
+func (c *Config) RemainingArgs() []string {
+	return c.remainingArgs
+}
+
 func (c *Config) usageOptions(addGeneral bool, skipped map[string]bool, relaxed map[string]bool) string {
 	var optBf bytes.Buffer
 
@@ -631,7 +1955,7 @@ func (c *Config) usageOptions(addGeneral bool, skipped map[string]bool, relaxed
 		if opt.Shortflag != "" {
 			left.WriteString("-" + opt.Shortflag + ", ")
 		}
-		left.WriteString("--" + optName)
+		left.WriteString(opt.FlagName())
 
 		if opt.Default != nil {
 
@@ -646,6 +1970,10 @@ func (c *Config) usageOptions(addGeneral bool, skipped map[string]bool, relaxed
 				}
 			case "json":
 				left.WriteString(fmt.Sprintf("='%s'", opt.Default))
+			case "list":
+				left.WriteString(fmt.Sprintf("='%s'", strings.Join(opt.Default.([]string), opt.listSeparator())))
+			case "binary":
+				left.WriteString(fmt.Sprintf("='%s'", base64.StdEncoding.EncodeToString(opt.Default.([]byte))))
 			case "time":
 				left.WriteString(fmt.Sprintf("='%s'", fmtdate.Format("hh:mm:ss", opt.Default.(time.Time))))
 			case "date":
@@ -672,18 +2000,44 @@ func (c *Config) usageOptions(addGeneral bool, skipped map[string]bool, relaxed
 			left.WriteString("]")
 		}
 
-		optBf.WriteString(pad("  "+left.String(), opt.Help))
+		help := opt.helpText()
+		if len(opt.AltNames) > 0 {
+			help += " (synonyms: --" + strings.Join(opt.AltNames, ", --") + ")"
+		}
+		// bools that default to true must be disabled explicitly
+		if opt.Type == "bool" && opt.Default == true {
+			help += fmt.Sprintf(" (default: true, disable with --%s=false)", optName)
+		}
+
+		optBf.WriteString(pad("  "+left.String(), help))
 		//optBf.WriteString("\t\t" + strings.Join(strings.Split(opt.Help, "\n"), "\n\t\t"))
 	}
 
 	if !c.isCommand() && addGeneral {
 		generalOptions := map[string]string{
 			"version":          "prints the current version of the program",
+			"version-json":     "prints the version of the program and its build info as JSON",
 			"help":             "prints the help",
+			"help-all":         "prints the help for the program and all of its commands",
 			"config-spec":      "prints the specification of the configurable options",
 			"config-env":       "prints the environmental variables of the configurable options",
 			"config-locations": "prints the locations of current configuration",
 			"config-files":     "prints the locations of the config files",
+			"config-file=PATH": "loads the given config file (- for stdin) after the environmental variables",
+			"config-json=PATH": "loads the configuration from the given JSON file (- for stdin) after the environmental variables",
+			"config-validate":  "validates the configuration, prints the errors as JSON and exits",
+			"export-env":       "prints the configuration as shell exports of the environmental variables",
+			"debug-config":     "prints the values of all options and their locations to stderr (--debug-config=json for JSON)",
+		}
+
+		if _, has := c.spec["env"]; !has {
+			generalOptions["env=NAME"] = "loads the config files for the given environment, see SetEnvironment"
+		}
+
+		for flag := range IntrospectionFlags {
+			if c.isFlagDisabled(flag) {
+				delete(generalOptions, flag)
+			}
 		}
 
 		for optname, opthelp := range generalOptions {
@@ -694,6 +2048,17 @@ func (c *Config) usageOptions(addGeneral bool, skipped map[string]bool, relaxed
 	return optBf.String()
 }
 
+// UsageAll returns the usage of the app followed by the usage of every command
+func (c *Config) UsageAll() string {
+	var bf bytes.Buffer
+	bf.WriteString(c.Usage())
+	c.EachSubSorted(func(name string, sub *Config) {
+		bf.WriteString("\n\n--------------------------------\n\n")
+		bf.WriteString(sub.Usage())
+	})
+	return bf.String()
+}
+
 func (c *Config) Usage() string {
 	/*
 			usage: git [--version] [--help] [-C <path>] [-c name=value]
@@ -776,7 +2141,79 @@ usage:
 }
 
 func (c *Config) env_var(optName string) string {
-	return strings.ToUpper(c.app + "_CONFIG_" + optName)
+	return envPrefix(c.app) + strings.ToUpper(optName)
+}
+
+// WriteShellExports writes the values of the config and its commands as shell
+// exports of their env variables (e.g. export MYAPP_CONFIG_NAME='value'), sorted
+// by name, so that they can be sourced by a shell, e.g. via
+//
+//	eval "$(myapp --export-env)"
+//
+// Unlike WriteCompact and --debug-config, the values of secret options are written in
+// clear text, since the shell needs them.
+func (c *Config) WriteShellExports(w io.Writer) error {
+	var err error
+	c.Walk(func(path []string, cfg *Config) {
+		for _, nv := range cfg.Values() {
+			if err != nil || nv.Value == nil {
+				continue
+			}
+			var val string
+			if val, err = valueToString(cfg.spec[nv.Name], nv.Value); err != nil {
+				return
+			}
+			_, err = fmt.Fprintf(w, "export %s=%s\n", cfg.env_var(nv.Name), shellQuote(val))
+		}
+	})
+	return err
+}
+
+// WriteCompact writes the values of the config and its commands in a single line
+// of the form key=value key2=value2, e.g. to log the effective configuration at startup.
+// The keys are the keys of config files, the values are quoted for the shell, if needed.
+// Values of secret options are masked, datetimes are written as RFC3339 and JSON is compacted.
+// No linefeed is written at the end.
+func (c *Config) WriteCompact(w io.Writer) error {
+	var pairs []string
+	var err error
+	c.Walk(func(path []string, cfg *Config) {
+		for _, nv := range cfg.Values() {
+			if err != nil || nv.Value == nil {
+				continue
+			}
+			key := nv.Name
+			if cfg.isCommand() {
+				key = cfg.commandName() + "_" + key
+			}
+
+			opt := cfg.spec[nv.Name]
+			var val string
+			switch {
+			case opt.Secret:
+				val = "***"
+			case opt.Type == "datetime":
+				val = nv.Value.(time.Time).Format(time.RFC3339)
+			default:
+				if val, err = valueToString(opt, nv.Value); err != nil {
+					return
+				}
+				if opt.Type == "json" {
+					var bf bytes.Buffer
+					if err = json.Compact(&bf, []byte(val)); err != nil {
+						return
+					}
+					val = bf.String()
+				}
+			}
+			pairs = append(pairs, key+"="+shellQuoteIfNeeded(val))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, strings.Join(pairs, " "))
+	return err
 }
 
 func (c *Config) envVars() []string {
@@ -787,15 +2224,40 @@ func (c *Config) envVars() []string {
 	return v
 }
 
+// isNumericOption checks if the option with the given name, alternative name or
+// shortflag is of type int32 or float32
+func (c *Config) isNumericOption(key string) bool {
+	if sh, has := c.shortflags[key]; has {
+		key = sh
+	}
+	spec, has := c.spec[c.canonicalName(key)]
+	return has && (spec.Type == "int32" || spec.Type == "float32")
+}
+
 func (c *Config) mergeArgs(ignoreUnknown bool, args []string, skippedOptions map[string]bool, relaxedOptions map[string]bool) (merged map[string]bool, err error) {
 	merged = map[string]bool{}
 	// prevent duplicates
 	keys := map[string]bool{}
+	var validate bool
+	var exportEnv bool
+	var debug string
+	var positionals []string
+	// the arg has been consumed as value of the previous flag
+	var consumed bool
 	// fmt.Printf("args: %#v\n", os.Args[1:])
 	for i, pair := range args {
+		if consumed {
+			consumed = false
+			continue
+		}
 		wrapErr := func(err error) error {
 			return InvalidConfigFlag{c.version, pair, err}
 		}
+		// negative numbers are never flags, since flags must start with a letter
+		if pair != "help" && (isNumber(pair) || len(c.positions) > 0 && !strings.HasPrefix(pair, "-")) {
+			positionals = append(positionals, pair)
+			continue
+		}
 		idx := strings.Index(pair, "=")
 		var key, val string
 		if idx != -1 {
@@ -806,19 +2268,31 @@ func (c *Config) mergeArgs(ignoreUnknown bool, args []string, skippedOptions map
 			key, val = pair[:idx], pair[idx+1:]
 
 			if val == "" {
-				err = EmptyValueError(key)
+				err = EmptyValueSourceError{EmptyValueError(key), SourceArgs, pair}
 				return
 			}
 		} else {
 			key = pair
 			val = "true"
+			// numeric options take a following number as value, e.g. --offset -5
+			if i+1 < len(args) && isNumber(args[i+1]) && c.isNumericOption(argToKey(key)) {
+				val = args[i+1]
+				consumed = true
+				merged[val] = true
+			}
 		}
 
 		argKey := key
 		key = argToKey(argKey)
 		// fmt.Println(argKey)
 
-		switch key {
+		// disabled introspection flags are handled like any other option
+		flag := key
+		if c.isFlagDisabled(key) {
+			flag = ""
+		}
+
+		switch flag {
 
 		case "config-env":
 			all := c.envVars()
@@ -853,13 +2327,17 @@ func (c *Config) mergeArgs(ignoreUnknown bool, args []string, skippedOptions map
 			os.Exit(0)
 		case "config-files":
 			cfgFiles := struct {
-				Global string `json:"global,omitempty"`
-				User   string `json:"user,omitempty"`
-				Local  string `json:"local,omitempty"`
+				Global  string          `json:"global,omitempty"`
+				User    string          `json:"user,omitempty"`
+				Runtime string          `json:"runtime,omitempty"`
+				Local   string          `json:"local,omitempty"`
+				Exists  map[string]bool `json:"exists"`
 			}{
-				c.FirstGlobalsFile(),
-				c.UserFile(),
-				c.LocalFile(),
+				c.SourceFile(SourceGlobals),
+				c.SourceFile(SourceUser),
+				c.SourceFile(SourceRuntime),
+				c.SourceFile(SourceLocals),
+				c.FileStatus(),
 			}
 			var bt []byte
 			bt, err = json.Marshal(cfgFiles)
@@ -869,13 +2347,40 @@ func (c *Config) mergeArgs(ignoreUnknown bool, args []string, skippedOptions map
 			}
 			fmt.Fprintf(os.Stdout, "%s\n", bt)
 			os.Exit(0)
+		case "config-file", "config-json":
+			// already loaded by Load
+			merged[argKey] = true
+		case "config-validate":
+			// validated after all args have been merged
+			validate = true
+			merged[argKey] = true
+		case "export-env":
+			// printed after all args have been merged
+			exportEnv = true
+			merged[argKey] = true
+		case "debug-config":
+			// printed after all args have been merged
+			debug = val
+			merged[argKey] = true
 		case "version":
 			fmt.Fprintf(os.Stdout, "%s version %s\n", c.appName(), c.version)
 			os.Exit(0)
+		case "version-json":
+			var bt []byte
+			bt, err = c.VersionJSON()
+			if err != nil {
+				err = wrapErr(fmt.Errorf("can't serialize version to json: %#v\n", err.Error()))
+				return
+			}
+			fmt.Fprintf(os.Stdout, "%s\n", bt)
+			os.Exit(0)
+		case "help-all":
+			fmt.Fprintf(os.Stdout, "%s\n", c.UsageAll())
+			os.Exit(0)
 		case "help":
 			if i+1 < len(args) {
 				subc := args[i+1]
-				sub, has := c.commands[subc]
+				sub, has := c.lookupCommand(subc)
 				if !has {
 					err = wrapErr(fmt.Errorf("unknown subcommand: %#v\n", subc))
 					return
@@ -929,6 +2434,35 @@ func (c *Config) mergeArgs(ignoreUnknown bool, args []string, skippedOptions map
 			if sh, has := c.shortflags[key]; has {
 				key = sh
 			}
+			key = c.canonicalName(key)
+
+			spec, has := c.spec[key]
+
+			// the environment is already respected by the config files, see SetEnvironment
+			if key == "env" && !has && c.parent == nil {
+				merged[argKey] = true
+				continue
+			}
+
+			// every occurrence of the flag adds a value to lists that are not split
+			if has && spec.Type == "list" && spec.NoSplit {
+				var out interface{}
+				out, err = c.parseValue(key, val)
+				if err != nil {
+					err = wrapErr(fmt.Errorf("invalid value for option %s: %s\n", key, err.Error()))
+					return
+				}
+				if keys[key] {
+					c.values[key] = append(c.values[key].([]string), out.([]string)...)
+				} else {
+					c.values[key] = out
+				}
+				c.locations[key] = append(c.locations[key], argKey)
+				c.explicitSet[key] = true
+				merged[argKey] = true
+				keys[key] = true
+				continue
+			}
 
 			if keys[key] {
 				err = ErrDoubleOption(key)
@@ -936,10 +2470,17 @@ func (c *Config) mergeArgs(ignoreUnknown bool, args []string, skippedOptions map
 			}
 
 			// fmt.Println(key)
-			_, has := c.spec[key]
 			if ignoreUnknown && !has {
 				continue
 			}
+
+			if !has {
+				if scopeErr := c.optionScopeError(argKey, nil); scopeErr != nil {
+					err = scopeErr
+					return
+				}
+			}
+
 			err = c.set(key, val, argKey)
 			if err != nil {
 				err = wrapErr(fmt.Errorf("invalid value for option %s: %s\n", key, err.Error()))
@@ -950,6 +2491,103 @@ func (c *Config) mergeArgs(ignoreUnknown bool, args []string, skippedOptions map
 		}
 	}
 
+	// positional args are taken by the active command only, see Load
+	if c.activeCommand != nil {
+		positionals = nil
+	}
+
+	for i, val := range positionals {
+		location := fmt.Sprintf("#%d", i+1)
+		key, has := c.positions[i+1]
+		if !has {
+			if ignoreUnknown {
+				continue
+			}
+			err = UnknownOptionError{c.version, val}
+			return
+		}
+
+		// flags take precedence, but must not conflict with the positional arg
+		if keys[key] {
+			var out interface{}
+			out, err = c.parseValue(key, val)
+			if err != nil {
+				err = InvalidConfigFlag{c.version, location, err}
+				return
+			}
+			if !reflect.DeepEqual(out, c.values[key]) {
+				err = PositionalConflictError{key, c.values[key], out}
+				return
+			}
+		} else {
+			err = c.set(key, val, location)
+			if err != nil {
+				err = InvalidConfigFlag{c.version, location, err}
+				return
+			}
+			keys[key] = true
+		}
+		merged[val] = true
+	}
+
+	c.argsSet = make([]string, 0, len(keys))
+	for key := range keys {
+		c.argsSet = append(c.argsSet, key)
+	}
+	sort.Strings(c.argsSet)
+
+	if err = c.resolveFromCommands(); err != nil {
+		return
+	}
+
+	if err = c.resolveDefaultsFrom(); err != nil {
+		return
+	}
+
+	if err = c.resolveReferences(); err != nil {
+		return
+	}
+
+	if debug != "" {
+		switch {
+		case c.parent != nil:
+			err = c.parent.writeTrace(os.Stderr, debug == "json")
+		case c.activeCommand == nil:
+			err = c.writeTrace(os.Stderr, debug == "json")
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	if exportEnv {
+		switch {
+		case c.parent != nil:
+			err = c.parent.WriteShellExports(os.Stdout)
+		case c.activeCommand == nil:
+			err = c.WriteShellExports(os.Stdout)
+		default:
+			// printed by the active command, when its args are merged
+			return
+		}
+		if err != nil {
+			return
+		}
+		os.Exit(0)
+	}
+
+	if validate {
+		switch {
+		case c.parent != nil:
+			c.parent.printValidation()
+		case c.activeCommand == nil:
+			c.printValidation()
+		default:
+			// validated by the active command, when its args are merged
+			return
+		}
+	}
+
 	if err = c.ValidateValues(); err != nil {
 		return
 	}
@@ -962,7 +2600,7 @@ func (c Config) GetBool(option string) bool {
 	if err := ValidateName(option); err != nil {
 		panic(InvalidNameError(option))
 	}
-	v, has := c.values[option]
+	v, has := c.value(option)
 	if has {
 		return v.(bool)
 	}
@@ -974,7 +2612,7 @@ func (c Config) GetFloat32(option string) float32 {
 	if err := ValidateName(option); err != nil {
 		panic(InvalidNameError(option))
 	}
-	v, has := c.values[option]
+	v, has := c.value(option)
 	if has {
 		return v.(float32)
 	}
@@ -986,7 +2624,7 @@ func (c Config) GetInt32(option string) int32 {
 	if err := ValidateName(option); err != nil {
 		panic(InvalidNameError(option))
 	}
-	v, has := c.values[option]
+	v, has := c.value(option)
 	if has {
 		return v.(int32)
 	}
@@ -998,23 +2636,34 @@ func (c Config) GetValue(option string) interface{} {
 	if err := ValidateName(option); err != nil {
 		panic(InvalidNameError(option))
 	}
-	v, has := c.values[option]
+	v, has := c.value(option)
 	if has {
 		return v
 	}
 	return nil
 }
 
-// GetTime returns the value of the option as time
-func (c Config) GetTime(option string) (t time.Time) {
+// GetTime returns the value of the option as time.
+// If the option is not set, the zero time is returned.
+func (c Config) GetTime(option string) time.Time {
+	return c.GetTimeOr(option, time.Time{})
+}
+
+// GetTimeOr returns the value of the option as time.
+// If the option is not set or is no time, the fallback is returned.
+func (c Config) GetTimeOr(option string, fallback time.Time) time.Time {
 	if err := ValidateName(option); err != nil {
 		panic(InvalidNameError(option))
 	}
-	v, has := c.values[option]
-	if has {
-		t = v.(time.Time)
+	v, has := c.value(option)
+	if !has {
+		return fallback
 	}
-	return
+	t, ok := v.(time.Time)
+	if !ok {
+		return fallback
+	}
+	return t
 }
 
 // GetString returns the value of the option as string
@@ -1022,19 +2671,43 @@ func (c Config) GetString(option string) string {
 	if err := ValidateName(option); err != nil {
 		panic(InvalidNameError(option))
 	}
-	v, has := c.values[option]
+	v, has := c.value(option)
 	if has {
 		return v.(string)
 	}
 	return ""
 }
 
+// GetList returns the value of the option as list of strings
+func (c Config) GetList(option string) []string {
+	if err := ValidateName(option); err != nil {
+		panic(InvalidNameError(option))
+	}
+	v, has := c.value(option)
+	if has {
+		return v.([]string)
+	}
+	return nil
+}
+
+// GetBinary returns the value of the binary option (decoded from base64)
+func (c Config) GetBinary(option string) []byte {
+	if err := ValidateName(option); err != nil {
+		panic(InvalidNameError(option))
+	}
+	v, has := c.value(option)
+	if has {
+		return v.([]byte)
+	}
+	return nil
+}
+
 // GetJSON unmarshals the value of the option to val.
 func (c Config) GetJSON(option string, val interface{}) error {
 	if err := ValidateName(option); err != nil {
 		panic(InvalidNameError(option))
 	}
-	v, has := c.values[option]
+	v, has := c.value(option)
 	if has {
 		return json.Unmarshal([]byte(v.(string)), val)
 	}
@@ -1046,21 +2719,41 @@ func (c Config) GetJSON(option string, val interface{}) error {
 // if an error happens
 // the given perm is only used to create new files.
 func (c *Config) WriteConfigFile(path string, perm os.FileMode) (err error) {
+	return c.writeConfigFile(c.fileSystem(), path, perm, false)
+}
+
+// WriteConfigFileTo is like WriteConfigFile, but writes to the given FileSystem
+func (c *Config) WriteConfigFileTo(fsys FileSystem, path string, perm os.FileMode) (err error) {
+	return c.writeConfigFile(fsys, path, perm, false)
+}
+
+// WriteConfigFileCompact is like WriteConfigFile, but writes the compact format
+// without the documentation block and the help comments, i.e. the header line
+// followed by one line per option (multiline values still span several lines).
+// The compact format is read like any other config file.
+func (c *Config) WriteConfigFileCompact(path string, perm os.FileMode) (err error) {
+	return c.writeConfigFile(c.fileSystem(), path, perm, true)
+}
+
+func (c *Config) writeConfigFile(fsys FileSystem, path string, perm os.FileMode, compact bool) (err error) {
 	if c.isCommand() {
 		return errors.New("WriteConfigFile must not be called in sub command")
 	}
 	if errValid := c.ValidateValues(); errValid != nil {
 		return errValid
 	}
+	if errPrefix := ValidatePrefixes(); errPrefix != nil {
+		return errPrefix
+	}
 	dir := filepath.FromSlash(filepath.Dir(path))
-	info, errDir := os.Stat(dir)
+	info, errDir := fsys.Stat(dir)
 
 	if errDir == nil && !info.IsDir() {
 		return fmt.Errorf("%s is no directory", dir)
 	}
 
 	if os.IsNotExist(errDir) {
-		errDir = os.MkdirAll(dir, 0755)
+		errDir = fsys.MkdirAll(dir, 0755)
 	}
 
 	if errDir != nil {
@@ -1069,13 +2762,13 @@ func (c *Config) WriteConfigFile(path string, perm os.FileMode) (err error) {
 
 	path = filepath.FromSlash(path)
 
-	backup, errBackup := ioutil.ReadFile(path)
-	backupInfo, errInfo := os.Stat(path)
+	backup, errBackup := fsys.ReadFile(path)
+	backupInfo, errInfo := fsys.Stat(path)
 	// don't write anything, if we have no config values
 	if len(c.values) == 0 {
 		// files exist, but will be deleted (no config values)
 		if errInfo == nil {
-			return os.Remove(path)
+			return fsys.Remove(path)
 		}
 		// files does not exist, we have no values, so lets do nothing
 		return nil
@@ -1086,7 +2779,7 @@ func (c *Config) WriteConfigFile(path string, perm os.FileMode) (err error) {
 	if errInfo == nil {
 		perm = backupInfo.Mode()
 	}
-	file, errCreate := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	file, errCreate := fsys.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
 	if errCreate != nil {
 		return errCreate
 	}
@@ -1094,76 +2787,109 @@ func (c *Config) WriteConfigFile(path string, perm os.FileMode) (err error) {
 	defer func() {
 		file.Close()
 		if err != nil {
-			os.Remove(path)
+			fsys.Remove(path)
 			if len(backup) != 0 {
-				ioutil.WriteFile(path, backup, perm)
+				fsys.WriteFile(path, backup, perm)
 			}
 		}
 	}()
 
-	// _, err = file.WriteString(c.app + " " + c.version + string(delim))
-	_, err = file.WriteString(c.app + " " + c.version +
-		"\n# Don't delete the first line!" +
-		"\n#" +
-		"\n# This is a configuration file for the command " + c.app + " of the version " + c.version + " and compatible versions." +
-		"\n# All available options can be found by running" +
-		"\n#" +
-		"\n#           " + c.app + " --help-all" +
-		"\n#" +
-		"\n# ------------ FILE FORMAT ------------" +
-		"\n#" +
-		"\n# 1. all lines end in Unix format (LF)" +
-		"\n# 2. the first line must be 'xxxx yyy' where 'xxxx' is the command name and 'yyy' is the command version" +
-		"\n# 3. a line starting with '#' is a comment" +
-		"\n# 4. a line starting with '$' is an option key and must have the format" +
-		"\n#    '$xxxx=yyy' where 'xxxx' is the option name " +
-		"\n#    and 'yyy' is the value. The '=' may be surrounded by whitespace and the value 'yyy'" +
-		"\n#    may begin after a linefeed" +
-		"\n# 5. the option name is like the corresponding arg without any prefixing '-'" +
-		"\n#    and subcommand options are prefixed with the name of the" +
-		"\n#    subcommand followed by an underscore '_'" +
-		"\n# 6. Every line that does not begin with '#' or '$' is part of the value of the previous option key." +
-		"\n#" +
-		"\n# ------------ EXAMPLE ------------" +
-		"\n#" +
-		"\n#           git 2.1" +
-		"\n#           # a value in the same line as the option" +
-		"\n#           $commit_all=true" +
-		"\n#           # a multiline value starting in the line after the option" +
-		"\n#           $commit_message=" +
-		"\n#           a commit message that spans" +
-		"\n#           # comments are ignored" +
-		"\n#           several lines" +
-		"\n#           # a value in the same line as the option, = surrounded by whitespace" +
-		"\n#           $commit_cleanup = verbatim" +
-		"\n#" +
-		"\n# The above configuration corresponds to the following command invokation (in bash):" +
-		"\n#" +
-		"\n#           git commit --all --cleanup=verbatim --message=$'a commit message that spans\\nseveral lines'" +
-		"\n#" +
-		"\n# ------------ CONFIGURATION ------------" +
-		"\n#",
-	)
+	header := c.app + " " + c.version
+	if !compact {
+		// _, err = file.WriteString(c.app + " " + c.version + string(delim))
+		header += c.fileHeaderComment()
+	}
+	_, err = file.WriteString(header)
 	if err != nil {
 		return
 	}
 
-	return c.writeConfigValues(file)
+	if err = c.writeConfigValues(file, compact); err != nil {
+		return
+	}
+
+	// POSIX: the last line ends with a linefeed, too
+	_, err = file.WriteString("\n")
+	return
 }
 
-func (c *Config) writeConfigValues(file *os.File) (err error) {
+// SetFileHeader sets the comment that is written by WriteConfigFile after the
+// mandatory first line (app and version). Each line of the header is prefixed
+// with COMMENT_PREFIX. An empty header suppresses the comment. By default, a
+// description of the file format is written. SetFileHeader is chainable.
+func (c *Config) SetFileHeader(header string) *Config {
+	c.fileHeader = &header
+	return c
+}
 
-	for k, v := range c.values {
-		// do nothing for nil values
-		if v == nil {
-			continue
+// fileHeaderComment returns the comment that is written after the first line of config files
+func (c *Config) fileHeaderComment() string {
+	cm, op := COMMENT_PREFIX, OPTION_PREFIX
+
+	if c.fileHeader != nil {
+		if *c.fileHeader == "" {
+			return ""
 		}
+		var bf strings.Builder
+		for _, line := range strings.Split(*c.fileHeader, "\n") {
+			bf.WriteString(strings.TrimRight("\n"+cm+" "+line, " "))
+		}
+		return bf.String()
+	}
+
+	return "\n" + cm + " Don't delete the first line!" +
+		"\n" + cm +
+		"\n" + cm + " This is a configuration file for the command " + c.app + " of the version " + c.version + " and compatible versions." +
+		"\n" + cm + " All available options can be found by running" +
+		"\n" + cm +
+		"\n" + cm + "           " + c.app + " --help-all" +
+		"\n" + cm +
+		"\n" + cm + " ------------ FILE FORMAT ------------" +
+		"\n" + cm +
+		"\n" + cm + " 1. all lines end in Unix format (LF)" +
+		"\n" + cm + " 2. the first line must be 'xxxx yyy' where 'xxxx' is the command name and 'yyy' is the command version" +
+		"\n" + cm + " 3. a line starting with '" + cm + "' is a comment" +
+		"\n" + cm + " 4. a line starting with '" + op + "' is an option key and must have the format" +
+		"\n" + cm + "    '" + op + "xxxx=yyy' where 'xxxx' is the option name " +
+		"\n" + cm + "    and 'yyy' is the value. The '=' may be surrounded by whitespace and the value 'yyy'" +
+		"\n" + cm + "    may begin after a linefeed" +
+		"\n" + cm + " 5. the option name is like the corresponding arg without any prefixing '-'" +
+		"\n" + cm + "    and subcommand options are prefixed with the name of the" +
+		"\n" + cm + "    subcommand followed by an underscore '_'" +
+		"\n" + cm + " 6. Every line that does not begin with '" + cm + "' or '" + op + "' is part of the value of the previous option key." +
+		"\n" + cm + " 7. A leading backslash '\\' of such a line is removed, so that value lines beginning with" +
+		"\n" + cm + "    '" + cm + "', '" + op + "' or '\\' can be escaped by a backslash" +
+		"\n" + cm +
+		"\n" + cm + " ------------ EXAMPLE ------------" +
+		"\n" + cm +
+		"\n" + cm + "           git 2.1" +
+		"\n" + cm + "           " + cm + " a value in the same line as the option" +
+		"\n" + cm + "           " + op + "commit_all=true" +
+		"\n" + cm + "           " + cm + " a multiline value starting in the line after the option" +
+		"\n" + cm + "           " + op + "commit_message=" +
+		"\n" + cm + "           a commit message that spans" +
+		"\n" + cm + "           " + cm + " comments are ignored" +
+		"\n" + cm + "           several lines" +
+		"\n" + cm + "           " + cm + " a value in the same line as the option, = surrounded by whitespace" +
+		"\n" + cm + "           " + op + "commit_cleanup = verbatim" +
+		"\n" + cm +
+		"\n" + cm + " The above configuration corresponds to the following command invokation (in bash):" +
+		"\n" + cm +
+		"\n" + cm + "           git commit --all --cleanup=verbatim --message=$'a commit message that spans\\nseveral lines'" +
+		"\n" + cm +
+		"\n" + cm + " ------------ CONFIGURATION ------------" +
+		"\n" + cm
+}
 
-		help := strings.Split(c.spec[k].Help, "\n")
-		helplines := []string{}
+// writeConfigValues writes the values sorted by option name, followed by the
+// sections of the commands, sorted by command name, so that the output is stable
+func (c *Config) writeConfigValues(file io.StringWriter, compact bool) (err error) {
 
-		for _, h := range help {
-			helplines = append(helplines, strings.TrimSpace(h))
+	for _, nv := range c.Values() {
+		k, v := nv.Name, nv.Value
+		// do nothing for nil values
+		if v == nil {
+			continue
 		}
 
 		writeKey := k
@@ -1171,12 +2897,18 @@ func (c *Config) writeConfigValues(file *os.File) (err error) {
 			writeKey = c.commandName() + "_" + k
 		}
 
-		_, err = file.WriteString("\n# --- " + writeKey + " (" + c.spec[k].Type + ") ---\n#     " + strings.Join(helplines, "\n#     ") + "\n")
+		if compact {
+			_, err = file.WriteString("\n")
+		} else {
+			helplines := wrap(c.spec[k].helpText(), fileHelpWidth()-6)
+			cm := COMMENT_PREFIX
+			_, err = file.WriteString("\n" + cm + " --- " + writeKey + " (" + c.spec[k].Type + ") ---\n" + cm + "     " + strings.Join(helplines, "\n"+cm+"     ") + "\n")
+		}
 		if err != nil {
 			return
 		}
 
-		_, err = file.WriteString("$" + writeKey + "=")
+		_, err = file.WriteString(OPTION_PREFIX + writeKey + "=")
 		if err != nil {
 			return
 		}
@@ -1190,10 +2922,10 @@ func (c *Config) writeConfigValues(file *os.File) (err error) {
 			_, err = file.WriteString(fmt.Sprintf("%v", ty))
 		case string:
 			pre := ""
-			if len(ty) > 15 || strings.Contains(ty, "\n") {
+			if (len(ty) > 15 && !compact) || strings.Contains(ty, "\n") {
 				pre = "\n"
 			}
-			_, err = file.WriteString(pre + ty)
+			_, err = file.WriteString(escapeValue(pre + ty))
 		case time.Time:
 			var str string
 			switch c.spec[k].Type {
@@ -1207,7 +2939,16 @@ func (c *Config) writeConfigValues(file *os.File) (err error) {
 				return InvalidTypeError{k, c.spec[k].Type}
 				// return ErrInvalidType(c.spec[k].Type)
 			}
-			_, err = file.WriteString(" " + str)
+			_, err = file.WriteString(str)
+		case []byte:
+			_, err = file.WriteString(base64.StdEncoding.EncodeToString(ty))
+		case []string:
+			sep := c.spec[k].listSeparator()
+			pre := ""
+			if sep == "\n" {
+				pre = "\n"
+			}
+			_, err = file.WriteString(escapeValue(pre + strings.Join(ty, sep)))
 		default:
 			var bt []byte
 			bt, err = json.Marshal(ty)
@@ -1229,12 +2970,17 @@ func (c *Config) writeConfigValues(file *os.File) (err error) {
 		*/
 	}
 
-	for _, sub := range c.commands {
-		_, err = file.WriteString("\n# ------------ COMMAND " + sub.commandName() + " ------------\n#")
-		if err != nil {
+	for _, name := range c.commandNames() {
+		sub := c.commands[name]
+		if !compact {
+			_, err = file.WriteString("\n" + COMMENT_PREFIX + " ------------ COMMAND " + sub.commandName() + " ------------\n" + COMMENT_PREFIX)
+			if err != nil {
+				return
+			}
+		}
+		if err = sub.writeConfigValues(file, compact); err != nil {
 			return
 		}
-		sub.writeConfigValues(file)
 	}
 	return
 }
@@ -1,11 +1,26 @@
 package config
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -29,6 +44,7 @@ func withTempConfig(fn func()) error {
 	USER_DIR = filepath.Join(dir, "user")
 	GLOBAL_DIRS = filepath.Join(dir, "global")
 	WORKING_DIR = filepath.Join(dir, "local")
+	RUNTIME_DIR = ""
 
 	fn()
 	return nil
@@ -170,7 +186,7 @@ func TestConfig(t *testing.T) {
 		for _, test := range tests {
 			cfg, er := New("testapp", "0.1", "a testapp")
 			if er != nil {
-				t.Errorf(er.Error())
+				t.Error(er.Error())
 			}
 			setters := []func(*Option){}
 
@@ -254,3 +270,3844 @@ func TestConfig(t *testing.T) {
 	}
 
 }
+
+func TestValidateOptionValue(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewInt32("age", "the age")
+
+	if err := cfg.ValidateOptionValue("age", "42"); err != nil {
+		t.Errorf("ValidateOptionValue(%#v, %#v) = %v; want nil", "age", "42", err)
+	}
+
+	if err := cfg.ValidateOptionValue("age", "old"); err == nil {
+		t.Errorf("ValidateOptionValue(%#v, %#v) = nil; want error", "age", "old")
+	}
+
+	if err := cfg.ValidateOptionValue("size", "42"); err == nil {
+		t.Errorf("ValidateOptionValue(%#v, %#v) = nil; want error", "size", "42")
+	}
+
+	if cfg.IsSet("age") {
+		t.Errorf("ValidateOptionValue must not set the value")
+	}
+}
+
+func TestMergeBOM(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("name", "the name")
+
+	file := "\ufefftestapp 0.1\n$name=Donald\n"
+
+	if err := cfg.Merge(strings.NewReader(file), "bom.conf"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := cfg.GetString("name"), "Donald"; got != want {
+		t.Errorf("name = %#v; want %#v", got, want)
+	}
+}
+
+func TestValidateAll(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("name", "the name")
+	project := cfg.MustCommand("project", "a project")
+	project.NewString("title", "the title", Required)
+	cfg.MustCommand("other", "another command").NewString("path", "the path", Required)
+
+	// required options of inactive commands are not checked
+	if err := cfg.ValidateAll(); err != nil {
+		t.Errorf("ValidateAll() = %v; want nil", err)
+	}
+
+	cfg.activeCommand = project
+
+	err := cfg.ValidateAll()
+	want := CommandError{"project", MissingOptionError{"0.1", "title", ""}}
+	if err != want {
+		t.Errorf("ValidateAll() = %v; want %v", err, want)
+	}
+
+	project.Set("title", "my project", "")
+
+	if err := cfg.ValidateAll(); err != nil {
+		t.Errorf("ValidateAll() = %v; want nil", err)
+	}
+}
+
+func TestCommandInheritsParentValues(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewBool("verbose", "verbose output")
+	cfg.NewString("name", "the name")
+	project := cfg.MustCommand("project", "a project").Skip("name")
+
+	cfg.Set("verbose", "true", "")
+	cfg.Set("name", "Donald", "")
+
+	if !project.IsSet("verbose") || !project.GetBool("verbose") {
+		t.Errorf("project.GetBool(%#v) = false; want true", "verbose")
+	}
+
+	if project.IsSet("name") {
+		t.Errorf("project.IsSet(%#v) = true; want false for skipped option", "name")
+	}
+}
+
+func TestPositional(t *testing.T) {
+	tests := []struct {
+		args []string
+		src  string
+		dst  string
+		err  error
+	}{
+		{[]string{"a", "b"}, "a", "b", nil},
+		{[]string{"--src=a", "--dst=b"}, "a", "b", nil},
+		{[]string{"--dst=b", "a"}, "a", "b", nil},
+		{[]string{"--src=a", "a", "b"}, "a", "b", nil},
+		{[]string{"--src=x", "a", "b"}, "", "", PositionalConflictError{"src", "x", "a"}},
+		{[]string{"a", "b", "c"}, "", "", UnknownOptionError{"0.1", "c"}},
+	}
+
+	for _, test := range tests {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		src := cfg.NewString("src", "the source", Positional(1))
+		dst := cfg.NewString("dst", "the destination", Positional(2))
+		empty := map[string]bool{}
+
+		_, err := cfg.mergeArgs(false, test.args, empty, empty)
+
+		if err != test.err {
+			t.Errorf("mergeArgs(%#v) returned error %v; want %v", test.args, err, test.err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if src.Get() != test.src || dst.Get() != test.dst {
+			t.Errorf("mergeArgs(%#v) src = %#v dst = %#v; want %#v and %#v", test.args, src.Get(), dst.Get(), test.src, test.dst)
+		}
+	}
+}
+
+func TestPositionalOfCommand(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	src := cfg.NewString("src", "the source", Positional(1))
+	project := cfg.MustCommand("project", "a project")
+	name := project.NewString("name", "the name", Positional(1))
+
+	cfg.SetArgs([]string{"project", "a"})
+	cfg.SetEnv([]string{})
+
+	if err := cfg.Load(true); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := name.Get(), "a"; got != want {
+		t.Errorf("project name = %#v; want %#v", got, want)
+	}
+
+	if cfg.IsSet("src") {
+		t.Errorf("src = %#v; want it not to be set by the positional arg of the command", src.Get())
+	}
+}
+
+func TestPositionalList(t *testing.T) {
+	tests := []struct {
+		args     []string
+		files    string
+		conflict bool
+	}{
+		{[]string{"--files=a", "a"}, "a", false},
+		{[]string{"--files=a,b", "a,b"}, "a|b", false},
+		{[]string{"--files=a", "b"}, "", true},
+	}
+
+	for _, test := range tests {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		files := cfg.NewList("files", "the files", Positional(1))
+		empty := map[string]bool{}
+
+		_, err := cfg.mergeArgs(false, test.args, empty, empty)
+
+		if _, isConflict := err.(PositionalConflictError); isConflict != test.conflict {
+			t.Errorf("mergeArgs(%#v) returned error %v; want conflict: %v", test.args, err, test.conflict)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if got := strings.Join(files.Get(), "|"); got != test.files {
+			t.Errorf("mergeArgs(%#v) files = %#v; want %#v", test.args, got, test.files)
+		}
+	}
+}
+
+func TestParent(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	project := cfg.MustCommand("project", "a project")
+
+	if got := project.Parent(); got != cfg {
+		t.Errorf("project.Parent() = %p; want %p", got, cfg)
+	}
+
+	if got := cfg.Parent(); got != nil {
+		t.Errorf("cfg.Parent() = %p; want nil", got)
+	}
+}
+
+func TestTreeJSON(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("name", "the name")
+	project := cfg.MustCommand("project", "a project")
+	project.NewJSON("tags", "the tags")
+
+	cfg.Set("name", "Donald", "")
+	project.Set("tags", `["a","b"]`, "")
+
+	got, err := cfg.TreeJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"values":{"name":"Donald"},"commands":{"project":{"values":{"tags":["a","b"]}}}}`
+	if string(got) != want {
+		t.Errorf("TreeJSON() = %s; want %s", got, want)
+	}
+}
+
+func TestLoadGlobalsMultipleDirs(t *testing.T) {
+	err := withTempConfig(func() {
+		first := GLOBAL_DIRS
+		second := filepath.Join(filepath.Dir(first), "global2")
+		if err := os.Mkdir(second, 0755); err != nil {
+			t.Fatal(err)
+		}
+		GLOBAL_DIRS = first + string(os.PathListSeparator) + second
+
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		name := cfg.NewString("name", "the name")
+
+		if got, want := cfg.FirstGlobalsFile(), cfg.globalsFile(first); got != want {
+			t.Errorf("FirstGlobalsFile() = %#v; want %#v", got, want)
+		}
+
+		cfg.Set("name", "Daisy", "")
+		if err := cfg.WriteConfigFile(cfg.globalsFile(second), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg.Reset()
+
+		if err := cfg.LoadGlobals(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := name.Get(), "Daisy"; got != want {
+			t.Errorf("name = %#v; want %#v", got, want)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetConfigExt(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp").SetConfigExt(".ini")
+	project := cfg.MustCommand("project", "a project")
+
+	if got, want := cfg.UserFile(), filepath.Join(USER_DIR, "testapp", "testapp.ini"); got != want {
+		t.Errorf("UserFile() = %#v; want %#v", got, want)
+	}
+
+	if got, want := project.LocalFile(), filepath.Join(WORKING_DIR, ".config", "testapp", "testapp.ini"); got != want {
+		t.Errorf("LocalFile() = %#v; want %#v", got, want)
+	}
+}
+
+func TestSearchLocalInParents(t *testing.T) {
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		name := cfg.NewString("name", "the name")
+
+		cfg.Set("name", "Minnie", "")
+		if err := cfg.SaveToLocal(); err != nil {
+			t.Fatal(err)
+		}
+		cfg.Reset()
+
+		WORKING_DIR = filepath.Join(WORKING_DIR, "sub", "dir")
+
+		if err := cfg.LoadLocals(); err != nil {
+			t.Fatal(err)
+		}
+
+		if name.IsSet() {
+			t.Errorf("name must not be set without SearchLocalInParents")
+		}
+
+		cfg.SearchLocalInParents()
+
+		if err := cfg.LoadLocals(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := name.Get(), "Minnie"; got != want {
+			t.Errorf("name = %#v; want %#v", got, want)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStatus(t *testing.T) {
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		cfg.NewString("name", "the name")
+
+		cfg.Set("name", "Mickey", "")
+		if err := cfg.SaveToUser(); err != nil {
+			t.Fatal(err)
+		}
+
+		status := cfg.FileStatus()
+		if !status["user"] || status["local"] || status["global"] {
+			t.Errorf("FileStatus() = %v; want only user to exist", status)
+		}
+
+		// the global file is only inside the second global dir and the local
+		// file is inside the parent of the working dir
+		second := filepath.Join(filepath.Dir(USER_DIR), "global2")
+		GLOBAL_DIRS = strings.Join([]string{GLOBAL_DIRS, second}, string(filepath.ListSeparator))
+		global := cfg.globalsFile(second)
+		local := cfg.localFile(filepath.Dir(WORKING_DIR))
+		for _, file := range []string{global, local} {
+			if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(file, []byte("testapp 0.1\n$name=Donald\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cfg.SearchLocalInParents()
+
+		status = cfg.FileStatus()
+		if !status["user"] || !status["local"] || !status["global"] {
+			t.Errorf("FileStatus() = %v; want user, local and global to exist", status)
+		}
+
+		if got, want := cfg.SourceFile(SourceGlobals), global; got != want {
+			t.Errorf("SourceFile(SourceGlobals) = %#v; want %#v", got, want)
+		}
+
+		if got, want := cfg.SourceFile(SourceLocals), local; got != want {
+			t.Errorf("SourceFile(SourceLocals) = %#v; want %#v", got, want)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListNoSplitTransform(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	upper := func(s string) (string, error) {
+		if s == "Goofy" {
+			return "", fmt.Errorf("Goofy is not allowed")
+		}
+		return strings.ToUpper(s), nil
+	}
+	names := cfg.NewList("names", "the names", ListSeparator(""), AltNames("labels"), Transform(upper))
+	empty := map[string]bool{}
+
+	args := []string{"--names=Donald", "--labels=Daisy"}
+	if _, err := cfg.mergeArgs(false, args, empty, empty); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := strings.Join(names.Get(), "|"), "DONALD|DAISY"; got != want {
+		t.Errorf("names = %#v; want %#v", got, want)
+	}
+
+	cfg.Reset()
+	if _, err := cfg.mergeArgs(false, []string{"--names=Donald", "--names=Goofy"}, empty, empty); err == nil {
+		t.Errorf("mergeArgs() = nil; want error for failing transform")
+	}
+}
+
+func TestListSeparator(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	tags := cfg.NewList("tags", "the tags")
+	paths := cfg.NewList("paths", "the paths", ListSeparator(";"))
+	names := cfg.NewList("names", "the names", ListSeparator(""))
+	empty := map[string]bool{}
+
+	args := []string{"--tags=a, b", "--paths=x,y;z", "--names=Donald, Duck", "--names=Daisy"}
+	if _, err := cfg.mergeArgs(false, args, empty, empty); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{"tags", tags.Get(), []string{"a", "b"}},
+		{"paths", paths.Get(), []string{"x,y", "z"}},
+		{"names", names.Get(), []string{"Donald, Duck", "Daisy"}},
+	}
+
+	for _, test := range tests {
+		if strings.Join(test.got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%s = %#v; want %#v", test.name, test.got, test.want)
+		}
+	}
+
+	err := withTempConfig(func() {
+		if err := cfg.SaveToLocal(); err != nil {
+			t.Fatal(err)
+		}
+		cfg.Reset()
+		if err := cfg.LoadLocals(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range tests {
+			got := cfg.GetList(test.name)
+			if strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Errorf("%s = %#v after reading the file; want %#v", test.name, got, test.want)
+			}
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsumedAndRemainingArgs(t *testing.T) {
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		cfg.NewBool("verbose", "verbose output")
+		project := cfg.MustCommand("project", "a project")
+		project.NewString("name", "the name")
+
+		ENV = []string{}
+		ARGS = []string{"project", "--verbose", "--name=x", "--", "--other", "arg"}
+
+		if err := cfg.Load(true); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := strings.Join(cfg.ConsumedArgs(), " "), "project --verbose --name=x"; got != want {
+			t.Errorf("ConsumedArgs() = %#v; want %#v", got, want)
+		}
+
+		if got, want := strings.Join(cfg.RemainingArgs(), " "), "--other arg"; got != want {
+			t.Errorf("RemainingArgs() = %#v; want %#v", got, want)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpecEqual(t *testing.T) {
+	newCfg := func(def string) *Config {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		cfg.NewString("name", "the name", Default(def), Shortflag('n'))
+		cfg.NewBool("verbose", "verbose output")
+		return cfg
+	}
+
+	a, b := newCfg("Donald"), newCfg("Donald")
+	b.Set("name", "Daisy", "")
+
+	if !a.SpecEqual(b) {
+		t.Errorf("SpecEqual() = false; want true for same definitions")
+	}
+
+	if a.SpecEqual(newCfg("Daisy")) {
+		t.Errorf("SpecEqual() = true; want false for different defaults")
+	}
+
+	c := newCfg("Donald")
+	c.NewInt32("age", "the age")
+
+	if a.SpecEqual(c) {
+		t.Errorf("SpecEqual() = true; want false for different options")
+	}
+
+	data, err := a.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := MustNew("testapp", "0.1", "a testapp")
+	if err := d.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if !a.SpecEqual(d) {
+		t.Errorf("SpecEqual() = false; want true for unmarshalled spec")
+	}
+}
+
+func TestLoadTwice(t *testing.T) {
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		project := cfg.MustCommand("project", "a project")
+		name := project.NewString("name", "the name")
+
+		ENV = []string{}
+		ARGS = []string{"project", "--name=x"}
+
+		for i := 0; i < 2; i++ {
+			if err := cfg.Load(true); err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.ActiveCommand() != project {
+				t.Errorf("Load #%d: ActiveCommand() = %p; want %p", i+1, cfg.ActiveCommand(), project)
+			}
+
+			if got, want := name.Get(), "x"; got != want {
+				t.Errorf("Load #%d: name = %#v; want %#v", i+1, got, want)
+			}
+		}
+
+		if got, want := len(ARGS), 2; got != want {
+			t.Errorf("len(ARGS) = %d; want %d", got, want)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetDefaultsFS(t *testing.T) {
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		name := cfg.NewString("name", "the name", Default("Donald"))
+
+		fsys := fstest.MapFS{
+			"defaults.conf": &fstest.MapFile{Data: []byte("testapp 0.1\n$name=Daisy\n")},
+		}
+		cfg.SetDefaultsFS(fsys, "defaults.conf")
+
+		ENV = []string{}
+		ARGS = []string{}
+
+		if err := cfg.Load(true); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := name.Get(), "Daisy"; got != want {
+			t.Errorf("name = %#v; want %#v", got, want)
+		}
+
+		if err := MergeFS(cfg, fsys, "missing.conf", "missing.conf"); err == nil {
+			t.Errorf("MergeFS() = nil; want error for missing file")
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOptionScopeError(t *testing.T) {
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		cfg.NewBool("verbose", "verbose output")
+		cfg.MustCommand("project", "a project").NewString("name", "the name", Shortflag('n'))
+		cfg.MustCommand("other", "another command")
+
+		ENV = []string{}
+
+		tests := []struct {
+			args []string
+			err  error
+		}{
+			{[]string{"--name=x"}, OptionScopeError{"0.1", "--name", "project"}},
+			{[]string{"-n=x"}, OptionScopeError{"0.1", "-n", "project"}},
+			{[]string{"other", "--name=x"}, OptionScopeError{"0.1", "--name", "project"}},
+			{[]string{"other", "--size=x"}, UnknownOptionError{"0.1", "--size=x"}},
+			{[]string{"project", "--verbose", "--name=x"}, nil},
+		}
+
+		for _, test := range tests {
+			ARGS = test.args
+			if got := cfg.Load(true); got != test.err {
+				t.Errorf("Load() with %#v = %v; want %v", test.args, got, test.err)
+			}
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetTransform(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	name := cfg.NewString("name", "the name")
+	cfg.SetTransform("name", func(v interface{}) (interface{}, error) {
+		s := strings.ToLower(strings.TrimSpace(v.(string)))
+		if s == "" {
+			return nil, errors.New("empty name")
+		}
+		return s, nil
+	})
+
+	if err := cfg.Set("name", " DONALD ", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := name.Get(), "donald"; got != want {
+		t.Errorf("name = %#v; want %#v", got, want)
+	}
+
+	err := cfg.Set("name", "  ", "")
+	if _, ok := err.(TransformError); !ok {
+		t.Errorf("Set() returned %T; want TransformError", err)
+	}
+}
+
+func TestBoolFlagsWithValues(t *testing.T) {
+	for _, arg := range []string{"-l=false", "--locations=false", "-l=0", "--locations=f"} {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		locations := cfg.NewBool("locations", "show locations", Default(true), Shortflag('l'))
+		cfg.LoadDefaults()
+		empty := map[string]bool{}
+
+		if _, err := cfg.mergeArgs(false, []string{arg}, empty, empty); err != nil {
+			t.Errorf("mergeArgs(%#v) returned error %v", arg, err)
+			continue
+		}
+
+		if locations.Get() {
+			t.Errorf("mergeArgs(%#v): locations = true; want false", arg)
+		}
+	}
+}
+
+func TestEachSubSorted(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	for _, name := range []string{"project", "commit", "status"} {
+		cfg.MustCommand(name, "the "+name+" command")
+	}
+
+	var names []string
+	cfg.EachSubSorted(func(name string, sub *Config) {
+		if sub.Parent() != cfg {
+			t.Errorf("command %s has wrong parent", name)
+		}
+		names = append(names, name)
+	})
+
+	if got, want := strings.Join(names, ","), "commit,project,status"; got != want {
+		t.Errorf("EachSubSorted() visited %#v; want %#v", got, want)
+	}
+}
+
+func TestNegativeNumbers(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	offset := cfg.NewInt32("offset", "the offset")
+	ratio := cfg.NewFloat32("ratio", "the ratio")
+	start := cfg.NewInt32("start", "the start", Positional(1))
+	factor := cfg.NewFloat32("factor", "the factor", Positional(2))
+	empty := map[string]bool{}
+
+	args := []string{"--offset=-5", "--ratio=-1.5", "-3", "-0.25"}
+	if _, err := cfg.mergeArgs(false, args, empty, empty); err != nil {
+		t.Fatal(err)
+	}
+
+	if offset.Get() != -5 || ratio.Get() != -1.5 || start.Get() != -3 || factor.Get() != -0.25 {
+		t.Errorf("mergeArgs(%#v): offset = %v, ratio = %v, start = %v, factor = %v", args, offset.Get(), ratio.Get(), start.Get(), factor.Get())
+	}
+}
+
+func TestNegativeNumbersWithoutPositionals(t *testing.T) {
+	newCfg := func() *Config {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		cfg.NewInt32("offset", "the offset", Shortflag('o'))
+		cfg.NewFloat32("ratio", "the ratio")
+		cfg.NewBool("inf", "infinite")
+		return cfg
+	}
+	empty := map[string]bool{}
+
+	cfg := newCfg()
+	args := []string{"--offset", "-5", "--ratio", "-1.5e1", "--inf"}
+	if _, err := cfg.mergeArgs(false, args, empty, empty); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GetInt32("offset") != -5 || cfg.GetFloat32("ratio") != -15 || !cfg.GetBool("inf") {
+		t.Errorf("mergeArgs(%#v): offset = %v, ratio = %v, inf = %v", args, cfg.GetInt32("offset"), cfg.GetFloat32("ratio"), cfg.GetBool("inf"))
+	}
+
+	cfg = newCfg()
+	args = expandShortflags([]string{"-o", "-7"}, cfg)
+	if _, err := cfg.mergeArgs(false, args, empty, empty); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.GetInt32("offset"), int32(-7); got != want {
+		t.Errorf("offset = %v; want %v", got, want)
+	}
+
+	// numbers that are no value of a flag are unknown args
+	if _, err := newCfg().mergeArgs(false, []string{"-3"}, empty, empty); err != (UnknownOptionError{"0.1", "-3"}) {
+		t.Errorf("mergeArgs(-3) returned error %v; want UnknownOptionError", err)
+	}
+}
+
+func TestMultilineValueWithBlankLines(t *testing.T) {
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		message := cfg.NewString("message", "the message")
+		cfg.NewString("name", "the name")
+
+		want := "first paragraph\n\n\nsecond paragraph"
+		cfg.Set("message", want, "")
+		cfg.Set("name", "Donald", "")
+
+		if err := cfg.SaveToLocal(); err != nil {
+			t.Fatal(err)
+		}
+		cfg.Reset()
+
+		if err := cfg.LoadLocals(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := message.Get(); got != want {
+			t.Errorf("message = %#v; want %#v", got, want)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetTimeOr(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	start := cfg.NewDate("start", "the start")
+	fallback := time.Date(2014, 12, 24, 0, 0, 0, 0, time.UTC)
+
+	if got := start.GetOr(fallback); !got.Equal(fallback) {
+		t.Errorf("GetOr() = %v; want %v", got, fallback)
+	}
+
+	cfg.Set("start", "2015-01-01", "")
+
+	if got, want := start.GetOr(fallback), time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("GetOr() = %v; want %v", got, want)
+	}
+}
+
+func TestBoolDefaultTrue(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewBool("color", "colored output", Default(true))
+
+	if usage := cfg.Usage(); !strings.Contains(usage, "(default: true,") {
+		t.Errorf("Usage() does not show the default of color:\n%s", usage)
+	}
+
+	err := withTempConfig(func() {
+		sources := []struct {
+			name  string
+			setup func()
+		}{
+			{"file", func() {
+				cfg.Set("color", "false", "")
+				if err := cfg.SaveToUser(); err != nil {
+					t.Fatal(err)
+				}
+			}},
+			{"env", func() { ENV = []string{"TESTAPP_CONFIG_COLOR=false"} }},
+			{"args", func() { ARGS = []string{"--color=false"} }},
+		}
+
+		for _, source := range sources {
+			cfg.Reset()
+			os.Remove(cfg.UserFile())
+			ENV = []string{}
+			ARGS = []string{}
+			source.setup()
+
+			if err := cfg.Load(true); err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.GetBool("color") {
+				t.Errorf("color = true; want false when set via %s", source.name)
+			}
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrefixes(t *testing.T) {
+	defer func() {
+		COMMENT_PREFIX, OPTION_PREFIX = "#", "$"
+	}()
+
+	err := withTempConfig(func() {
+		COMMENT_PREFIX, OPTION_PREFIX = "%", "@"
+
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		name := cfg.NewString("name", "the name")
+
+		cfg.Set("name", "#1 $ duck", "")
+		if err := cfg.SaveToLocal(); err != nil {
+			t.Fatal(err)
+		}
+		cfg.Reset()
+
+		if err := cfg.LoadLocals(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := name.Get(), "#1 $ duck"; got != want {
+			t.Errorf("name = %#v; want %#v", got, want)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prefixes := range [][2]string{{"#", "#"}, {"a", "$"}, {"#", "-"}, {"##", "$"}, {"", "$"}} {
+		COMMENT_PREFIX, OPTION_PREFIX = prefixes[0], prefixes[1]
+		if ValidatePrefixes() == nil {
+			t.Errorf("ValidatePrefixes() = nil; want error for %#v", prefixes)
+		}
+	}
+}
+
+func TestArgsSet(t *testing.T) {
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		cfg.NewBool("verbose", "verbose output", Shortflag('v'))
+		cfg.NewString("name", "the name", Default("Donald"))
+		cfg.NewString("city", "the city")
+		project := cfg.MustCommand("project", "a project")
+		project.NewString("title", "the title")
+
+		ENV = []string{"TESTAPP_CONFIG_CITY=Duckburg"}
+		ARGS = []string{"project", "--title=x", "-v"}
+
+		if err := cfg.Load(true); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := strings.Join(cfg.ArgsSet(), ","), "verbose"; got != want {
+			t.Errorf("cfg.ArgsSet() = %#v; want %#v", got, want)
+		}
+
+		if got, want := strings.Join(project.ArgsSet(), ","), "title"; got != want {
+			t.Errorf("project.ArgsSet() = %#v; want %#v", got, want)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMarshalValueJSON(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewDate("start", "the start")
+	cfg.NewJSON("tags", "the tags")
+	cfg.NewInt32("age", "the age")
+
+	cfg.Set("start", "2014-12-24", "")
+	cfg.Set("tags", `["a","b"]`, "")
+
+	tests := []struct {
+		option string
+		want   string
+	}{
+		{"start", `{"option":"start","type":"date","value":"2014-12-24"}`},
+		{"tags", `{"option":"tags","type":"json","value":["a","b"]}`},
+		{"age", `{"option":"age","type":"int32","value":null}`},
+	}
+
+	for _, test := range tests {
+		got, err := cfg.MarshalValueJSON(test.option)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.want {
+			t.Errorf("MarshalValueJSON(%#v) = %s; want %s", test.option, got, test.want)
+		}
+	}
+}
+
+func TestIsDefault(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("name", "the name", Default("Donald"))
+	cfg.NewString("city", "the city")
+
+	cfg.LoadDefaults()
+
+	if !cfg.IsDefault("name") {
+		t.Errorf("IsDefault(%#v) = false; want true", "name")
+	}
+
+	if cfg.IsDefault("city") {
+		t.Errorf("IsDefault(%#v) = true; want false", "city")
+	}
+
+	cfg.Set("name", "Donald", "args")
+
+	if cfg.IsDefault("name") {
+		t.Errorf("IsDefault(%#v) = true; want false after Set", "name")
+	}
+}
+
+func TestWriteConfigFileCompact(t *testing.T) {
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		cfg.NewString("name", "the name")
+		cfg.NewInt32("age", "the age")
+		project := cfg.MustCommand("project", "a project")
+		project.NewString("title", "the title")
+
+		cfg.Set("name", "Donald Fauntleroy Duck", "")
+		project.Set("title", "Duckburg", "")
+
+		path := cfg.LocalFile()
+		if err := cfg.WriteConfigFileCompact(path, 0640); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := string(data), "testapp 0.1\n$name=Donald Fauntleroy Duck\n$project_title=Duckburg\n"; got != want {
+			t.Errorf("compact file = %#v; want %#v", got, want)
+		}
+
+		cfg.Reset()
+		project.Reset()
+
+		if err := cfg.LoadLocals(); err != nil {
+			t.Fatal(err)
+		}
+
+		if cfg.GetString("name") != "Donald Fauntleroy Duck" || project.GetString("title") != "Duckburg" {
+			t.Errorf("name = %#v, title = %#v after reading the compact file", cfg.GetString("name"), project.GetString("title"))
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEscapeMultilineValues(t *testing.T) {
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		message := cfg.NewString("message", "the message")
+
+		want := "a message with lines starting with special characters\n$not_an_option=1\n# no comment\n\\# escaped\n\\backslash"
+		if len(want) < 100 {
+			want += strings.Repeat(".", 100-len(want))
+		}
+		cfg.Set("message", want, "")
+
+		if err := cfg.SaveToLocal(); err != nil {
+			t.Fatal(err)
+		}
+		cfg.Reset()
+
+		if err := cfg.LoadLocals(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := message.Get(); got != want {
+			t.Errorf("message = %#v; want %#v", got, want)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeKeepsBackslashLines(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	path := cfg.NewString("path", "the path")
+
+	file := "testapp 0.1\n$path=first\n\\\\server\\share\n\\n\n\\$escaped\n"
+	if err := cfg.Merge(strings.NewReader(file), "old.conf"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := path.Get(), "first\n\\\\server\\share\n\\n\n$escaped"; got != want {
+		t.Errorf("path = %#v; want %#v", got, want)
+	}
+}
+
+func TestMergeEnvValidatesValues(t *testing.T) {
+	defer func() { ENV = []string{} }()
+
+	for _, env := range []string{"TESTAPP_CONFIG_AGE=99999999999", "TESTAPP_CONFIG_AGE=old", "TESTAPP_CONFIG_TAGS={"} {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		cfg.NewInt32("age", "the age")
+		cfg.NewJSON("tags", "the tags")
+
+		ENV = []string{env}
+		err := cfg.MergeEnv()
+
+		if _, ok := err.(InvalidConfigEnv); !ok {
+			t.Errorf("MergeEnv() with %#v returned %v; want InvalidConfigEnv", env, err)
+		}
+
+		if cfg.IsSet("age") || cfg.IsSet("tags") {
+			t.Errorf("MergeEnv() with %#v must not set invalid values", env)
+		}
+	}
+
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewInt32("age", "the age")
+	cfg.SetTransform("age", func(v interface{}) (interface{}, error) {
+		return "old", nil
+	})
+
+	ENV = []string{"TESTAPP_CONFIG_AGE=42"}
+
+	if _, ok := cfg.MergeEnv().(InvalidConfigEnv); !ok || cfg.IsSet("age") {
+		t.Errorf("MergeEnv() must reject values that don't match the option after the transformation")
+	}
+}
+
+func TestHas(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("name", "the name")
+	cfg.NewString("city", "the city")
+	cfg.Set("name", "Donald", "")
+
+	tests := []struct {
+		option string
+		want   bool
+	}{
+		{"name", true},
+		{"city", false},
+		{"unknown", false},
+		{"Invalid_Name", false},
+	}
+
+	for _, test := range tests {
+		if got := cfg.Has(test.option); got != test.want {
+			t.Errorf("Has(%#v) = %v; want %v", test.option, got, test.want)
+		}
+	}
+}
+
+func TestMergeValidatesValues(t *testing.T) {
+	files := []string{
+		"testapp 0.1\n$age=old\n$name=Donald",
+		"testapp 0.1\n$name=Donald\n$age=99999999999",
+		"testapp 0.1\n$project_tags={",
+	}
+
+	for _, file := range files {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		cfg.NewInt32("age", "the age")
+		cfg.NewString("name", "the name")
+		cfg.MustCommand("project", "a project").NewJSON("tags", "the tags")
+
+		err := cfg.Merge(strings.NewReader(file), "test.conf")
+		if _, ok := err.(InvalidConfigFileError); !ok {
+			t.Errorf("Merge(%#v) returned %v; want InvalidConfigFileError", file, err)
+		}
+	}
+}
+
+func TestValues(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("name", "the name")
+	cfg.NewInt32("age", "the age")
+	cfg.NewBool("male", "is male")
+	cfg.Set("name", "Donald", "")
+	cfg.Set("age", "42", "")
+
+	vals := cfg.Values()
+	want := []NamedValue{{"age", int32(42)}, {"name", "Donald"}}
+
+	if len(vals) != len(want) {
+		t.Fatalf("Values() = %#v; want %#v", vals, want)
+	}
+
+	for i := range want {
+		if vals[i] != want[i] {
+			t.Errorf("Values()[%d] = %#v; want %#v", i, vals[i], want[i])
+		}
+	}
+}
+
+func TestMergeURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/testapp.conf":
+			fmt.Fprint(w, "testapp 0.1\n$name=Daisy\n")
+		case "/large.conf":
+			fmt.Fprint(w, "testapp 0.1\n$name="+strings.Repeat("x", 100))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	defer func(max int64) { MaxURLSize = max }(MaxURLSize)
+	MaxURLSize = 50
+
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	name := cfg.NewString("name", "the name")
+
+	if err := MergeURL(cfg, srv.URL+"/testapp.conf", "remote"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := name.Get(), "Daisy"; got != want {
+		t.Errorf("name = %#v; want %#v", got, want)
+	}
+
+	for _, path := range []string{"/missing.conf", "/large.conf"} {
+		if err := MergeURL(cfg, srv.URL+path, "remote"); err == nil {
+			t.Errorf("MergeURL(%#v) = nil; want error", path)
+		}
+	}
+}
+
+func TestMergeURLVerified(t *testing.T) {
+	data := "testapp 0.1\n$name=Daisy\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, data)
+	}))
+	defer srv.Close()
+
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	name := cfg.NewString("name", "the name")
+
+	err := MergeURLVerified(cfg, srv.URL+"/testapp.conf", "remote", strings.Repeat("0", 64))
+	if _, isChecksumErr := err.(ChecksumError); !isChecksumErr {
+		t.Errorf("MergeURLVerified() = %v; want ChecksumError", err)
+	}
+
+	if name.IsSet() {
+		t.Errorf("MergeURLVerified() must not merge anything on checksum mismatch")
+	}
+
+	sum := sha256.Sum256([]byte(data))
+	if err := MergeURLVerified(cfg, srv.URL+"/testapp.conf", "remote", hex.EncodeToString(sum[:])); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := name.Get(), "Daisy"; got != want {
+		t.Errorf("name = %#v; want %#v", got, want)
+	}
+}
+
+func TestLoadFileVerified(t *testing.T) {
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		name := cfg.NewString("name", "the name")
+
+		path := filepath.Join(WORKING_DIR, "verified.conf")
+		data := []byte("testapp 0.1\n$name=Donald\n")
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+
+		if err := LoadFileVerified(cfg, path, strings.Repeat("0", 64)); err == nil {
+			t.Errorf("LoadFileVerified() = nil; want ChecksumError")
+		}
+
+		if name.IsSet() {
+			t.Errorf("LoadFileVerified() must not merge anything on checksum mismatch")
+		}
+
+		if err := LoadFileVerified(cfg, path, hex.EncodeToString(sum[:])); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := name.Get(), "Donald"; got != want {
+			t.Errorf("name = %#v; want %#v", got, want)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigFileArg(t *testing.T) {
+	defer func() { STDIN = os.Stdin }()
+
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		name := cfg.NewString("name", "the name")
+		city := cfg.NewString("city", "the city")
+		project := cfg.MustCommand("project", "a project")
+		title := project.NewString("title", "the title")
+
+		path := filepath.Join(WORKING_DIR, "explicit.conf")
+		if err := ioutil.WriteFile(path, []byte("testapp 0.1\n$name=Daisy\n$city=Duckburg\n$project_title=x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		ENV = []string{"TESTAPP_CONFIG_NAME=Donald", "TESTAPP_CONFIG_CITY=Entenhausen"}
+		ARGS = []string{"project", "--config-file=" + path, "--city=Calisota"}
+
+		if err := cfg.Load(true); err != nil {
+			t.Fatal(err)
+		}
+
+		if name.Get() != "Daisy" || city.Get() != "Calisota" || title.Get() != "x" {
+			t.Errorf("name = %#v, city = %#v, title = %#v; want \"Daisy\", \"Calisota\", \"x\"", name.Get(), city.Get(), title.Get())
+		}
+
+		STDIN = strings.NewReader("testapp 0.1\n$name=Gustav")
+		ENV = []string{}
+		ARGS = []string{"--config-file=-"}
+
+		if err := cfg.Load(true); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := name.Get(), "Gustav"; got != want {
+			t.Errorf("name = %#v; want %#v", got, want)
+		}
+
+		ARGS = []string{"--config-file=" + filepath.Join(WORKING_DIR, "missing.conf")}
+
+		if err := cfg.Load(true); err == nil {
+			t.Errorf("Load() = nil; want error for missing config file")
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetPrecedence(t *testing.T) {
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		name := cfg.NewString("name", "the name")
+
+		cfg.Set("name", "Minnie", "")
+		if err := cfg.SaveToLocal(); err != nil {
+			t.Fatal(err)
+		}
+
+		ENV = []string{"TESTAPP_CONFIG_NAME=Batman"}
+		ARGS = []string{}
+
+		if err := cfg.SetPrecedence([]Source{SourceGlobals, SourceUser, SourceEnv, SourceLocals}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cfg.Load(true); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := name.Get(), "Minnie"; got != want {
+			t.Errorf("name = %#v; want %#v", got, want)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the precedence applies to commands too
+	err = withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		project := cfg.MustCommand("project", "a project")
+		title := project.NewString("title", "the title", Default("untitled"))
+
+		os.MkdirAll(filepath.Dir(cfg.LocalFile()), 0755)
+		if err := ioutil.WriteFile(cfg.LocalFile(), []byte("testapp 0.1\n$project_title=Minnie"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		ENV = []string{"TESTAPP_PROJECT_CONFIG_TITLE=Batman"}
+		defer func() { ENV = []string{} }()
+		cfg.SetArgs([]string{"project"})
+
+		if err := cfg.Load(true); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := title.Get(), "Batman"; got != want {
+			t.Errorf("title = %#v; want %#v with default precedence", got, want)
+		}
+
+		if err := cfg.SetPrecedence([]Source{SourceGlobals, SourceUser, SourceEnv, SourceLocals}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cfg.Load(true); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := title.Get(), "Minnie"; got != want {
+			t.Errorf("title = %#v; want %#v", got, want)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	invalid := [][]Source{
+		{SourceGlobals, SourceUser, SourceLocals},
+		{SourceGlobals, SourceUser, SourceLocals, SourceLocals},
+		{SourceGlobals, SourceUser, SourceLocals, Source("args")},
+		{SourceGlobals, SourceUser, SourceRuntime, SourceRuntime, SourceLocals, SourceEnv},
+	}
+
+	for _, sources := range invalid {
+		if err := cfg.SetPrecedence(sources); err == nil {
+			t.Errorf("SetPrecedence(%v) = nil; want error", sources)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	newCfg := func() *Config {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		cfg.NewString("name", "the name")
+		cfg.NewInt32("age", "the age")
+		cfg.NewDate("birthday", "the birthday")
+		return cfg
+	}
+
+	a := newCfg()
+	a.Set("name", "Minnie", "user")
+	a.Set("age", "12", "local")
+	a.Set("birthday", "2000-01-02", "user")
+
+	b := newCfg()
+	b.Set("birthday", "2000-01-02", "env")
+	b.Set("age", "12", "args")
+	b.Set("name", "Minnie", "global")
+
+	if a.Hash() != b.Hash() {
+		t.Errorf("hashes of equal values differ: %s vs %s", a.Hash(), b.Hash())
+	}
+
+	b.Set("age", "13", "args")
+
+	if a.Hash() == b.Hash() {
+		t.Errorf("hashes of different values are equal: %s", a.Hash())
+	}
+
+	if newCfg().Hash() == a.Hash() {
+		t.Errorf("hash of empty config equals hash of config with values")
+	}
+}
+
+func TestAltNames(t *testing.T) {
+	newCfg := func() (*Config, StringGetter) {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		color := cfg.NewString("color", "the color", AltNames("colour"))
+		return cfg, color
+	}
+
+	tests := []struct {
+		set  func(*Config) error
+		desc string
+	}{
+		{func(c *Config) error {
+			_, err := c.mergeArgs(false, []string{"--colour=red"}, nil, nil)
+			return err
+		}, "args"},
+		{func(c *Config) error {
+			ENV = []string{"TESTAPP_CONFIG_COLOUR=red"}
+			defer func() { ENV = []string{} }()
+			return c.MergeEnv()
+		}, "env"},
+		{func(c *Config) error {
+			return c.Merge(strings.NewReader("testapp 0.1\n$colour=red"), "file")
+		}, "file"},
+	}
+
+	var cfg *Config
+	var color StringGetter
+
+	for _, test := range tests {
+		cfg, color = newCfg()
+		if err := test.set(cfg); err != nil {
+			t.Fatalf("[%s] %s", test.desc, err)
+		}
+		if got, want := color.Get(), "red"; got != want {
+			t.Errorf("[%s] color = %#v; want %#v", test.desc, got, want)
+		}
+	}
+
+	if !strings.Contains(cfg.Usage(), "synonyms: --colour") {
+		t.Errorf("usage does not list the synonym: %s", cfg.Usage())
+	}
+
+	if _, err := cfg.NewOption("colour", "string", "collides with alt name", nil); err == nil {
+		t.Errorf("expected error for option colliding with alt name")
+	}
+
+	if _, err := cfg.NewOption("paint", "string", "collides with alt name", []func(*Option){AltNames("colour")}); err == nil {
+		t.Errorf("expected error for alt name colliding with alt name")
+	}
+
+	if _, err := cfg.NewOption("paint", "string", "collides with option", []func(*Option){AltNames("color")}); err == nil {
+		t.Errorf("expected error for alt name colliding with option")
+	}
+}
+
+func TestLoadedFiles(t *testing.T) {
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		cfg.NewString("name", "the name")
+
+		cfg.Set("name", "Minnie", "")
+		if err := cfg.SaveToLocal(); err != nil {
+			t.Fatal(err)
+		}
+
+		ENV = []string{}
+		ARGS = []string{}
+
+		if err := cfg.Load(true); err != nil {
+			t.Fatal(err)
+		}
+
+		local, _ := filepath.Abs(cfg.LocalFile())
+		if got, want := cfg.LoadedFiles(), []string{local}; !reflect.DeepEqual(got, want) {
+			t.Errorf("LoadedFiles() = %#v; want %#v", got, want)
+		}
+
+		// loading again must not accumulate the files
+		if err := cfg.Load(true); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := len(cfg.LoadedFiles()), 1; got != want {
+			t.Errorf("len(LoadedFiles()) = %v; want %v", got, want)
+		}
+
+		// a file that can't be merged is not listed
+		if err := ioutil.WriteFile(cfg.LocalFile(), []byte("othertestapp 0.1\n$name=Donald\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cfg.Load(true); err == nil {
+			t.Fatal("Load() = nil; want error for invalid local file")
+		}
+
+		if got := cfg.LoadedFiles(); len(got) != 0 {
+			t.Errorf("LoadedFiles() = %#v; want no files", got)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefaultFromOption(t *testing.T) {
+	tests := []struct {
+		args     []string
+		bindhost string
+	}{
+		{[]string{"--host=example.com"}, "example.com"},
+		{[]string{"--host=example.com", "--bindhost=localhost"}, "localhost"},
+		{[]string{}, "0.0.0.0"},
+	}
+
+	for _, test := range tests {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		cfg.NewString("host", "the host", Default("0.0.0.0"))
+		bindhost := cfg.NewString("bindhost", "the host to bind to", DefaultFromOption("host"), Required)
+
+		ARGS = test.args
+		ENV = []string{}
+
+		if err := cfg.Load(true); err != nil {
+			t.Fatalf("Load() with args %v: %s", test.args, err)
+		}
+
+		if got, want := bindhost.Get(), test.bindhost; got != want {
+			t.Errorf("bindhost with args %v = %#v; want %#v", test.args, got, want)
+		}
+	}
+
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("first", "the first", DefaultFromOption("third"))
+	cfg.NewString("second", "the second", DefaultFromOption("first"))
+	cfg.NewString("third", "the third", DefaultFromOption("second"))
+
+	ARGS = []string{"--first=a"}
+	ENV = []string{}
+
+	err := cfg.Load(true)
+
+	if _, isCycle := err.(DefaultCycleError); !isCycle {
+		t.Errorf("expected DefaultCycleError, got %#v", err)
+	}
+}
+
+func TestSetEnvironment(t *testing.T) {
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		name := cfg.NewString("name", "the name")
+
+		cfg.Set("name", "Minnie", "")
+		if err := cfg.SaveToUser(); err != nil {
+			t.Fatal(err)
+		}
+
+		prodFile := filepath.Join(filepath.Dir(cfg.UserFile()), "testapp.production"+CONFIG_EXT)
+		if err := ioutil.WriteFile(prodFile, []byte("testapp 0.1\n$name=Batman"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			env  []string
+			args []string
+			set  string
+			name string
+		}{
+			{[]string{}, []string{}, "", "Minnie"},
+			{[]string{}, []string{}, "production", "Batman"},
+			{[]string{}, []string{}, "staging", "Minnie"},
+			{[]string{"TESTAPP_ENV=production"}, []string{}, "", "Batman"},
+			{[]string{}, []string{"--env=production"}, "", "Batman"},
+		}
+
+		for _, test := range tests {
+			ENV = test.env
+			ARGS = test.args
+			cfg.SetEnvironment(test.set)
+
+			if err := cfg.Load(true); err != nil {
+				t.Fatalf("Load() with env %v, args %v and environment %#v: %s", test.env, test.args, test.set, err)
+			}
+
+			if got, want := name.Get(), test.name; got != want {
+				t.Errorf("name with env %v, args %v and environment %#v = %#v; want %#v", test.env, test.args, test.set, got, want)
+			}
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetLenientFiles(t *testing.T) {
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		name := cfg.NewString("name", "the name", Default("Minnie"))
+
+		cfg.Set("name", "Batman", "")
+		if err := cfg.SaveToUser(); err != nil {
+			t.Fatal(err)
+		}
+
+		// a truncated file without a valid header
+		if err := ioutil.WriteFile(cfg.UserFile(), []byte("testap"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		ENV = []string{}
+		ARGS = []string{}
+
+		if err := cfg.Load(true); err == nil {
+			t.Errorf("expected error for truncated user file")
+		}
+
+		var warnings []string
+		oldWarn := Warn
+		Warn = func(msg string) { warnings = append(warnings, msg) }
+		defer func() { Warn = oldWarn }()
+
+		cfg.SetLenientFiles(true)
+
+		if err := cfg.Load(true); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := name.Get(), "Minnie"; got != want {
+			t.Errorf("name = %#v; want %#v", got, want)
+		}
+
+		if got, want := len(warnings), 1; got != want {
+			t.Errorf("len(warnings) = %v; want %v", got, want)
+		}
+
+		if got, want := len(cfg.LoadedFiles()), 0; got != want {
+			t.Errorf("len(LoadedFiles()) = %v; want %v", got, want)
+		}
+
+		// explicit files still fail
+		ARGS = []string{"--config-file=" + cfg.UserFile()}
+
+		if err := cfg.Load(true); err == nil {
+			t.Errorf("expected error for truncated config file given via --config-file")
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelaxedJSONOption(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	rule := cfg.NewJSON("rule", "the rule", RelaxedJSON())
+	cfg.NewJSON("strict", "a strict rule")
+
+	ARGS = []string{"--rule={a:1,}"}
+	if err := cfg.MergeArgs(); err != nil {
+		t.Fatal(err)
+	}
+
+	var v map[string]int
+	if err := rule.Get(&v); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := v["a"], 1; got != want {
+		t.Errorf("rule.a = %v; want %v", got, want)
+	}
+
+	if err := cfg.Set("strict", "{a:1,}", "args"); err == nil {
+		t.Errorf("expected error for relaxed JSON in strict option")
+	}
+}
+
+func TestAppNameAndVersion(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	sub := cfg.MustCommand("project", "a project")
+
+	for _, c := range []*Config{cfg, sub} {
+		if got, want := c.AppName(), "testapp"; got != want {
+			t.Errorf("AppName() = %#v; want %#v", got, want)
+		}
+		if got, want := c.Version(), "0.1"; got != want {
+			t.Errorf("Version() = %#v; want %#v", got, want)
+		}
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	schema := `{
+		"type": "object",
+		"required": ["name"],
+		"additionalProperties": false,
+		"properties": {
+			"name": {"type": "string", "minLength": 2},
+			"ports": {"type": "array", "items": {"type": "integer", "minimum": 1, "maximum": 65535}},
+			"mode": {"enum": ["fast", "slow"]}
+		}
+	}`
+
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewJSON("server", "the server", JSONSchema(schema))
+
+	tests := []struct {
+		value string
+		path  string
+	}{
+		{`{"name": "web", "ports": [80, 443], "mode": "fast"}`, ""},
+		{`{"ports": [80]}`, "/"},
+		{`{"name": "web", "ports": [80, 0]}`, "/ports/1"},
+		{`{"name": "web", "ports": [80.5]}`, "/ports/0"},
+		{`{"name": "web", "mode": "medium"}`, "/mode"},
+		{`{"name": "w"}`, "/name"},
+		{`{"name": "web", "other": 1}`, "/"},
+		{`[]`, "/"},
+	}
+
+	for _, test := range tests {
+		err := cfg.Set("server", test.value, "args")
+		if test.path == "" {
+			if err != nil {
+				t.Errorf("Set(%s) returned error: %s", test.value, err)
+			}
+			continue
+		}
+		schemaErr, is := err.(SchemaError)
+		if !is {
+			t.Errorf("Set(%s) returned %#v; want SchemaError", test.value, err)
+			continue
+		}
+		if schemaErr.Path != test.path {
+			t.Errorf("Set(%s) failed at %#v; want %#v", test.value, schemaErr.Path, test.path)
+		}
+	}
+
+	if _, err := cfg.NewOption("invalid", "json", "invalid schema", []func(*Option){JSONSchema(`{"type": 1}`)}); err == nil {
+		t.Errorf("expected error for invalid schema")
+	}
+
+	if _, err := cfg.NewOption("name", "string", "schema for string", []func(*Option){JSONSchema(`{}`)}); err == nil {
+		t.Errorf("expected error for schema of non-json option")
+	}
+
+	for _, schema := range []string{
+		`{"properties": {"a": null}}`,
+		`{"items": null}`,
+		`{"additionalProperties": null}`,
+		`{"properties": {"a": {"items": null}}}`,
+	} {
+		if _, err := cfg.NewOption("null", "json", "null schema", []func(*Option){JSONSchema(schema)}); err == nil {
+			t.Errorf("expected error for schema %s", schema)
+		}
+	}
+
+	cfg.NewJSON("paths", "the paths", JSONSchema(`{"additionalProperties": {"type": "string"}}`))
+
+	err := cfg.Set("paths", `{"a/b~c": 1}`, "args")
+	if schemaErr, is := err.(SchemaError); !is || schemaErr.Path != "/a~1b~0c" {
+		t.Errorf("Set returned %#v; want SchemaError at %#v", err, "/a~1b~0c")
+	}
+}
+
+func TestHelpFunc(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	plugins := []string{"alpha"}
+	cfg.NewString("plugin", "", HelpFunc(func() string {
+		return "the plugin, one of " + strings.Join(plugins, ",")
+	}))
+
+	plugins = append(plugins, "beta")
+
+	if usage := cfg.Usage(); !strings.Contains(usage, "one of alpha,beta") {
+		t.Errorf("usage does not contain the generated help text: %s", usage)
+	}
+
+	if _, err := cfg.NewOption("other", "string", "", nil); err != ErrMissingHelp {
+		t.Errorf("expected ErrMissingHelp for missing help text, got %#v", err)
+	}
+}
+
+func TestValidationErrors(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("name", "the name", Required)
+	cfg.NewJSON("data", "the data")
+	cfg.NewInt32("age", "the age")
+	sub := cfg.MustCommand("project", "a project")
+	sub.NewString("title", "the title", Required)
+
+	cfg.values["data"] = "{invalid"
+	cfg.values["age"] = int32(3)
+
+	errs := cfg.validationErrors()
+
+	if got, want := len(errs), 2; got != want {
+		t.Fatalf("len(validationErrors()) = %v; want %v: %#v", got, want, errs)
+	}
+
+	if errs[0].Option != "data" || errs[0].Missing {
+		t.Errorf("errs[0] = %#v; want invalid data", errs[0])
+	}
+
+	if errs[1].Option != "name" || !errs[1].Missing {
+		t.Errorf("errs[1] = %#v; want missing name", errs[1])
+	}
+
+	cfg.activeCommand = sub
+	errs = cfg.validationErrors()
+
+	if got, want := len(errs), 3; got != want {
+		t.Fatalf("len(validationErrors()) = %v; want %v: %#v", got, want, errs)
+	}
+
+	if errs[2].Command != "project" || errs[2].Option != "title" || !errs[2].Missing {
+		t.Errorf("errs[2] = %#v; want missing project title", errs[2])
+	}
+}
+
+func TestValidateCollectsInvalidValues(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewInt32("age", "the age")
+	cfg.NewString("name", "the name")
+	sub := cfg.MustCommand("project", "a project")
+	sub.NewInt32("size", "the size")
+
+	cfg.SetArgs([]string{"project", "--config-validate"})
+	if !cfg.validateFlagGiven() {
+		t.Fatalf("validateFlagGiven() = false; want true")
+	}
+
+	cfg.validating = true
+	cfg.SetEnv([]string{"TESTAPP_CONFIG_AGE=abc", "TESTAPP_CONFIG_NAME=Donald"})
+
+	if err := cfg.MergeEnv(); err != nil {
+		t.Fatalf("MergeEnv() = %v; want nil", err)
+	}
+
+	if err := cfg.Merge(strings.NewReader("testapp 0.1\n$project_size=big\n"), "test.conf"); err != nil {
+		t.Fatalf("Merge() = %v; want nil", err)
+	}
+
+	if err := cfg.Set("unknown", "x", "test"); err == nil {
+		t.Errorf("Set() of unknown option = nil; want error")
+	}
+
+	if got, want := cfg.GetString("name"), "Donald"; got != want {
+		t.Errorf("name = %#v; want %#v", got, want)
+	}
+
+	errs := cfg.validationErrors()
+
+	if got, want := len(errs), 2; got != want {
+		t.Fatalf("len(validationErrors()) = %v; want %v: %#v", got, want, errs)
+	}
+
+	if errs[0].Option != "age" || errs[0].Location != "TESTAPP_CONFIG_AGE" || cfg.IsSet("age") {
+		t.Errorf("errs[0] = %#v; want invalid age from TESTAPP_CONFIG_AGE", errs[0])
+	}
+
+	if errs[1].Command != "project" || errs[1].Option != "size" || errs[1].Location != "test.conf" {
+		t.Errorf("errs[1] = %#v; want invalid project size from test.conf", errs[1])
+	}
+
+	cfg.Reset()
+	cfg.validating = false
+
+	if err := cfg.MergeEnv(); err == nil {
+		t.Errorf("MergeEnv() = nil; want error when not validating")
+	}
+}
+
+func TestSetValues(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	age := cfg.NewInt32("age", "the age")
+	tags := cfg.NewList("tags", "the tags")
+	birthday := cfg.NewDate("birthday", "the birthday")
+
+	bday := time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)
+	err := cfg.SetValues(map[string]interface{}{
+		"age":      int32(12),
+		"tags":     []string{"a", "b"},
+		"birthday": bday,
+	}, "computed")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := age.Get(), int32(12); got != want {
+		t.Errorf("age = %v; want %v", got, want)
+	}
+
+	if got, want := strings.Join(tags.Get(), ","), "a,b"; got != want {
+		t.Errorf("tags = %#v; want %#v", got, want)
+	}
+
+	if got, want := birthday.Get(), bday; !got.Equal(want) {
+		t.Errorf("birthday = %v; want %v", got, want)
+	}
+
+	if got, want := cfg.Locations("age"), []string{"computed"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("locations of age = %#v; want %#v", got, want)
+	}
+
+	// no value is set, if one of them is invalid
+	err = cfg.SetValues(map[string]interface{}{
+		"age":  int32(13),
+		"tags": "a,b",
+	}, "computed")
+
+	if err == nil {
+		t.Errorf("expected error for string value of list option")
+	}
+
+	if got, want := age.Get(), int32(12); got != want {
+		t.Errorf("age = %v; want %v", got, want)
+	}
+
+	if err := cfg.SetValues(map[string]interface{}{"unknown": 1}, ""); err == nil {
+		t.Errorf("expected error for unknown option")
+	}
+}
+
+func TestFromCommand(t *testing.T) {
+	if _, err := exec.LookPath("echo"); err != nil {
+		t.Skip("echo not available")
+	}
+
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	secret := cfg.NewString("secret", "the secret", FromCommand("echo", "s3cr3t"))
+
+	ARGS = []string{}
+	ENV = []string{}
+
+	if err := cfg.Load(true); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := secret.Get(), "s3cr3t"; got != want {
+		t.Errorf("secret = %#v; want %#v", got, want)
+	}
+
+	// the command is not run, if the option is set otherwise
+	cfg = MustNew("testapp", "0.1", "a testapp")
+	secret = cfg.NewString("secret", "the secret", FromCommand("command-that-does-not-exist"))
+
+	ARGS = []string{"--secret=given"}
+
+	if err := cfg.Load(true); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := secret.Get(), "given"; got != want {
+		t.Errorf("secret = %#v; want %#v", got, want)
+	}
+
+	ARGS = []string{}
+
+	err := cfg.Load(true)
+
+	if _, is := err.(CommandOutputError); !is {
+		t.Errorf("expected CommandOutputError, got %#v", err)
+	}
+}
+
+func TestBinary(t *testing.T) {
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		key := cfg.NewBinary("key", "the key")
+
+		data := []byte{0, 1, 2, '\n', '$', 255}
+		encoded := base64.StdEncoding.EncodeToString(data)
+
+		ARGS = []string{"--key=" + encoded}
+		ENV = []string{}
+
+		if err := cfg.Load(true); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := key.Get(); !bytes.Equal(got, data) {
+			t.Errorf("key = %#v; want %#v", got, data)
+		}
+
+		if err := cfg.SaveToUser(); err != nil {
+			t.Fatal(err)
+		}
+
+		ARGS = []string{}
+
+		if err := cfg.Load(true); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := key.Get(); !bytes.Equal(got, data) {
+			t.Errorf("key from file = %#v; want %#v", got, data)
+		}
+
+		if err := cfg.Set("key", "not base64!", "args"); err == nil {
+			t.Errorf("expected error for invalid base64")
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEach(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("name", "the name")
+	cfg.NewInt32("age", "the age", Default(int32(3)))
+	cfg.NewBool("active", "is active")
+	cfg.LoadDefaults()
+	cfg.Set("name", "Minnie", "")
+
+	var got []string
+	cfg.Each(func(name string, opt *Option, value interface{}, isSet bool) {
+		got = append(got, fmt.Sprintf("%s:%s:%v:%v", name, opt.Type, value, isSet))
+	})
+
+	want := []string{"active:bool:<nil>:false", "age:int32:3:true", "name:string:Minnie:true"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Each() yields %#v; want %#v", got, want)
+	}
+}
+
+func TestRequiredWithDefault(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+
+	var warnings []string
+	defer func(warn func(string)) { Warn = warn }(Warn)
+	Warn = func(msg string) { warnings = append(warnings, msg) }
+
+	if _, err := cfg.NewOption("name", "string", "the name", []func(*Option){Required, Default("Minnie")}); err != nil {
+		t.Errorf("unexpected error for required option with default: %s", err)
+	}
+
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "option name is required and has a default") {
+		t.Errorf("warnings = %#v; want warning for required option with default", warnings)
+	}
+
+	if err := cfg.CheckMissing(); err != nil {
+		t.Errorf("CheckMissing() = %v; want nil, since the default satisfies the requirement", err)
+	}
+
+	if _, err := cfg.NewOption("age", "int32", "the age", []func(*Option){Required}); err != nil {
+		t.Errorf("unexpected error for required option without default: %s", err)
+	}
+
+	if len(warnings) != 1 {
+		t.Errorf("warnings = %#v; want no warning for required option without default", warnings)
+	}
+}
+
+func TestSetFileHeader(t *testing.T) {
+	err := withTempConfig(func() {
+		tests := []struct {
+			header string
+			want   string
+		}{
+			{"my header\n\nsecond line", "testapp 0.1\n# my header\n#\n# second line\n"},
+			{"", "testapp 0.1\n"},
+		}
+
+		for _, test := range tests {
+			cfg := MustNew("testapp", "0.1", "a testapp")
+			name := cfg.NewString("name", "the name")
+			cfg.SetFileHeader(test.header)
+			cfg.Set("name", "Minnie", "")
+
+			if err := cfg.SaveToUser(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := ioutil.ReadFile(cfg.UserFile())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.HasPrefix(string(data), test.want) {
+				t.Errorf("config file with header %#v starts with %#v; want %#v", test.header, string(data), test.want)
+			}
+
+			cfg.Reset()
+			if err := cfg.LoadUser(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := name.Get(), "Minnie"; got != want {
+				t.Errorf("name = %#v; want %#v", got, want)
+			}
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUsageAll(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("name", "the name")
+	cfg.MustCommand("project", "manages projects").NewString("title", "the title of the project")
+	cfg.MustCommand("other", "does other things")
+
+	usage := cfg.UsageAll()
+
+	for _, want := range []string{"a testapp", "--help-all", "manages projects", "the title of the project", "does other things"} {
+		if !strings.Contains(usage, want) {
+			t.Errorf("UsageAll() does not contain %#v:\n%s", want, usage)
+		}
+	}
+
+	// the usage of the commands follows the usage of the app, sorted by command
+	commands := usage[len(cfg.Usage()):]
+	if strings.Index(commands, "does other things") > strings.Index(commands, "manages projects") {
+		t.Errorf("commands in UsageAll() are not sorted")
+	}
+}
+
+func TestWriteTrace(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("name", "the name", Default("Minnie"))
+	cfg.NewInt32("age", "the age")
+	cfg.MustCommand("project", "a project").NewString("title", "the title")
+
+	cfg.LoadDefaults()
+	cfg.Set("name", "Batman", "--name")
+
+	var bf bytes.Buffer
+	if err := cfg.writeTrace(&bf, false); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `age (int32) is not set
+name (string) = "Batman"
+  1. default Minnie
+  2. --name <- wins
+project title (string) is not set
+`
+	if got := bf.String(); got != want {
+		t.Errorf("trace = %#v; want %#v", got, want)
+	}
+
+	bf.Reset()
+	if err := cfg.writeTrace(&bf, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []traceEntry
+	if err := json.Unmarshal(bf.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := len(entries), 3; got != want {
+		t.Fatalf("len(entries) = %v; want %v", got, want)
+	}
+
+	if got, want := entries[1].Winner, "--name"; got != want {
+		t.Errorf("winner of name = %#v; want %#v", got, want)
+	}
+
+	// values of secret options are masked
+	cfg = MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("password", "the password", Default("geheim"), Secret)
+
+	cfg.LoadDefaults()
+	cfg.Set("password", "topsecret", "--password")
+
+	bf.Reset()
+	if err := cfg.writeTrace(&bf, false); err != nil {
+		t.Fatal(err)
+	}
+
+	want = `password (string) = "***"
+  1. default ***
+  2. --password <- wins
+`
+	if got := bf.String(); got != want {
+		t.Errorf("trace = %#v; want %#v", got, want)
+	}
+}
+
+func TestPromptMissing(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	name := cfg.NewString("name", "the name", Required)
+	age := cfg.NewInt32("age", "the age", Required)
+	password := cfg.NewString("password", "the password", Required, Secret)
+	cfg.NewString("city", "the city")
+
+	cfg.Set("name", "Minnie", "")
+
+	var out bytes.Buffer
+	in := strings.NewReader("\nnot a number\n12\ns3cr3t\n")
+
+	if err := cfg.PromptMissing(in, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := name.Get(), "Minnie"; got != want {
+		t.Errorf("name = %#v; want %#v", got, want)
+	}
+
+	if got, want := age.Get(), int32(12); got != want {
+		t.Errorf("age = %v; want %v", got, want)
+	}
+
+	if got, want := password.Get(), "s3cr3t"; got != want {
+		t.Errorf("password = %#v; want %#v", got, want)
+	}
+
+	if cfg.IsSet("city") {
+		t.Errorf("optional city must not be prompted for")
+	}
+
+	if got, want := strings.Count(out.String(), "age (int32): "), 3; got != want {
+		t.Errorf("age has been prompted for %v times; want %v:\n%s", got, want, out.String())
+	}
+
+	cfg.Reset()
+	err := cfg.PromptMissing(strings.NewReader(""), &out)
+
+	if _, is := err.(MissingOptionError); !is {
+		t.Errorf("expected MissingOptionError at EOF, got %#v", err)
+	}
+}
+
+func TestCommandCase(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+
+	if _, err := cfg.Command("Project", "a project"); err == nil {
+		t.Errorf("expected error for command name with uppercase letters")
+	}
+
+	project := cfg.MustCommand("project", "a project")
+	title := project.NewString("title", "the title")
+
+	for _, arg := range []string{"project", "Project", "PROJECT"} {
+		ARGS = []string{arg, "--title=x"}
+		ENV = []string{"TESTAPP_PROJECT_CONFIG_TITLE=y"}
+
+		if err := cfg.Load(true); err != nil {
+			t.Fatalf("Load() with command %#v: %s", arg, err)
+		}
+
+		if cfg.ActiveCommand() != project {
+			t.Errorf("command %#v is not active", arg)
+		}
+
+		if got, want := title.Get(), "x"; got != want {
+			t.Errorf("title with command %#v = %#v; want %#v", arg, got, want)
+		}
+	}
+
+	if sub, has := cfg.lookupCommand("PrOjEcT"); !has || sub != project {
+		t.Errorf("lookupCommand is not case-insensitive")
+	}
+}
+
+func TestWalk(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	project := cfg.MustCommand("project", "a project")
+	other := cfg.MustCommand("other", "another command")
+
+	var paths []string
+	var visited []*Config
+	cfg.Walk(func(path []string, c *Config) {
+		paths = append(paths, strings.Join(path, " "))
+		visited = append(visited, c)
+	})
+
+	if got, want := paths, []string{"", "other", "project"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("paths = %#v; want %#v", got, want)
+	}
+
+	if got, want := visited, []*Config{cfg, other, project}; !reflect.DeepEqual(got, want) {
+		t.Errorf("visited configs differ")
+	}
+}
+
+func TestTransform(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	trimQuotes := func(s string) (string, error) { return strings.Trim(s, `"'`), nil }
+	upper := func(s string) (string, error) { return strings.ToUpper(s), nil }
+	noDigits := func(s string) (string, error) {
+		if strings.ContainsAny(s, "0123456789") {
+			return "", errors.New("digits are not allowed")
+		}
+		return s, nil
+	}
+	name := cfg.NewString("name", "the name", Transform(trimQuotes), Transform(upper), Transform(noDigits))
+	age := cfg.NewInt32("age", "the age", Transform(trimQuotes))
+
+	ENV = []string{`TESTAPP_CONFIG_NAME="minnie"`}
+	if err := cfg.MergeEnv(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := name.Get(), "MINNIE"; got != want {
+		t.Errorf("name = %#v; want %#v", got, want)
+	}
+
+	if err := cfg.Set("age", "'12'", "args"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := age.Get(), int32(12); got != want {
+		t.Errorf("age = %v; want %v", got, want)
+	}
+
+	err := cfg.Set("name", "minnie2", "args")
+
+	if _, is := err.(TransformError); !is {
+		t.Errorf("expected TransformError, got %#v", err)
+	}
+	ENV = []string{}
+}
+
+func TestLoadRuntime(t *testing.T) {
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		name := cfg.NewString("name", "the name")
+		city := cfg.NewString("city", "the city")
+		ENV = []string{}
+		ARGS = []string{}
+
+		if got := cfg.RuntimeFile(); got != "" {
+			t.Errorf("RuntimeFile() = %#v; want empty string without RUNTIME_DIR", got)
+		}
+
+		if err := cfg.Load(true); err != nil {
+			t.Fatal(err)
+		}
+
+		RUNTIME_DIR = filepath.Join(USER_DIR, "..", "runtime")
+		defer func() { RUNTIME_DIR = "" }()
+
+		if got, want := cfg.RuntimeFile(), filepath.Join(RUNTIME_DIR, "testapp", "testapp.tmp"); got != want {
+			t.Errorf("RuntimeFile() = %#v; want %#v", got, want)
+		}
+
+		// a missing runtime file is no error
+		if err := cfg.Load(true); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg.Set("name", "Mickey", "")
+		cfg.Set("city", "Duckburg", "")
+		if err := cfg.SaveToUser(); err != nil {
+			t.Fatal(err)
+		}
+		cfg.Reset()
+		cfg.Set("name", "Minnie", "")
+		if err := cfg.SaveToLocal(); err != nil {
+			t.Fatal(err)
+		}
+
+		os.MkdirAll(filepath.Dir(cfg.RuntimeFile()), 0755)
+		content := "testapp 0.1\n$name=Goofy\n$city=Mousetown\n"
+		if err := ioutil.WriteFile(cfg.RuntimeFile(), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cfg.Load(true); err != nil {
+			t.Fatal(err)
+		}
+
+		// runtime overwrites user but not local
+		if got, want := name.Get(), "Minnie"; got != want {
+			t.Errorf("name = %#v; want %#v", got, want)
+		}
+
+		if got, want := city.Get(), "Mousetown"; got != want {
+			t.Errorf("city = %#v; want %#v", got, want)
+		}
+
+		if got, want := cfg.SourceOf("city"), SourceRuntime; got != want {
+			t.Errorf("SourceOf(city) = %#v; want %#v", got, want)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewPath(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip("no home dir")
+	}
+
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cache := cfg.NewPath("cache", "the cache dir", Default("~/.cache/testapp"))
+	data := cfg.NewPath("data", "the data dir")
+	raw := cfg.NewPath("raw", "the raw dir", NoExpand)
+	name := cfg.NewString("name", "the name")
+
+	ENV = []string{"DATA_HOME=/var/data"}
+	ARGS = []string{"--data=${DATA_HOME}/testapp", "--raw=~/$DATA_HOME", "--name=~$DATA_HOME"}
+	defer func() {
+		ENV = []string{}
+		ARGS = []string{}
+	}()
+
+	if err := cfg.Load(true); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		option string
+		getter StringGetter
+		want   string
+	}{
+		{"cache", cache, filepath.Join(home, ".cache", "testapp")},
+		{"data", data, "/var/data/testapp"},
+		{"raw", raw, "~/$DATA_HOME"},
+		{"name", name, "~$DATA_HOME"},
+	}
+
+	for _, test := range tests {
+		if got := test.getter.Get(); got != test.want {
+			t.Errorf("%s = %#v; want %#v", test.option, got, test.want)
+		}
+	}
+}
+
+func TestMergeEnvMultiWord(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	logLevel := cfg.NewString("loglevel", "the log level")
+
+	ENV = []string{"TESTAPP_CONFIG_LOGLEVEL=debug"}
+	defer func() { ENV = []string{} }()
+
+	if err := cfg.MergeEnv(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := logLevel.Get(), "debug"; got != want {
+		t.Errorf("loglevel = %#v; want %#v", got, want)
+	}
+
+	// option names can't contain underscores
+	ENV = []string{"TESTAPP_CONFIG_LOG_LEVEL=debug"}
+	cfg.Reset()
+
+	if _, is := cfg.MergeEnv().(InvalidConfigEnv); !is {
+		t.Errorf("expected InvalidConfigEnv error for TESTAPP_CONFIG_LOG_LEVEL")
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		content string
+		keys    []string
+		valid   bool
+	}{
+		{"testapp 1.2.3\n# a comment\n$name=Mickey\n$text=line one\n\nline two\n$sub_age=3\n", []string{"name", "text", "sub_age"}, true},
+		{"testapp 1.2.3\n", nil, true},
+		{"testapp\n$name=Mickey\n", nil, false},
+		{"testapp 1.2.3\n$name Mickey\n", nil, false},
+		{"testapp 1.2.3\n$name=Mickey\n$name=Minnie\n", nil, false},
+		{"testapp 1.2.3\n$name=\n", nil, false},
+		{"testapp 1.2.3\n$Name=Mickey\n", nil, false},
+	}
+
+	for i, test := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("test%d.conf", i))
+		if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		app, version, keys, err := CheckFile(path)
+
+		if !test.valid {
+			if _, is := err.(ConfigFileSyntaxError); !is {
+				t.Errorf("[%d] CheckFile(%#v) returned %#v; want ConfigFileSyntaxError", i, test.content, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("[%d] CheckFile(%#v) returned error %s", i, test.content, err)
+			continue
+		}
+
+		if app != "testapp" || version != "1.2.3" {
+			t.Errorf("[%d] CheckFile(%#v) = %#v, %#v; want \"testapp\", \"1.2.3\"", i, test.content, app, version)
+		}
+
+		if !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("[%d] CheckFile(%#v) keys = %#v; want %#v", i, test.content, keys, test.keys)
+		}
+	}
+}
+
+func TestSetArgs(t *testing.T) {
+	err := withTempConfig(func() {
+		newCfg := func(args ...string) (*Config, *Config, StringGetter) {
+			cfg := MustNew("testapp", "0.1", "a testapp").SetArgs(args)
+			project := cfg.MustCommand("project", "a project")
+			name := project.NewString("name", "the name", Default("Mickey"))
+			return cfg, project, name
+		}
+
+		ENV = []string{}
+		ARGS = []string{"--unknown"}
+
+		only, onlyProject, onlyName := newCfg("project")
+		other, otherProject, otherName := newCfg("project", "--name=Minnie")
+
+		for i := 0; i < 2; i++ {
+			if err := only.Load(true); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := other.Load(true); err != nil {
+				t.Fatal(err)
+			}
+
+			if only.ActiveCommand() != onlyProject || other.ActiveCommand() != otherProject {
+				t.Errorf("Load #%d: subcommand project is not active", i+1)
+			}
+
+			if got, want := onlyName.Get(), "Mickey"; got != want {
+				t.Errorf("Load #%d: name = %#v; want %#v", i+1, got, want)
+			}
+
+			if got, want := otherName.Get(), "Minnie"; got != want {
+				t.Errorf("Load #%d: name = %#v; want %#v", i+1, got, want)
+			}
+		}
+
+		if got, want := ARGS, []string{"--unknown"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("ARGS = %#v; want %#v", got, want)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteConfigFileGolden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("name", "the name")
+	cfg.NewInt32("age", "the age")
+	cfg.NewBool("active", "is active")
+	cfg.NewList("tags", "the tags")
+	zoo := cfg.MustCommand("zoo", "the zoo")
+	zoo.NewString("animal", "the animal")
+	zoo.NewInt32("count", "the count")
+	farm := cfg.MustCommand("farm", "the farm")
+	farm.NewString("owner", "the owner")
+	farm.NewBool("open", "is open")
+
+	values := map[string]string{"name": "Mickey", "age": "42", "active": "true", "tags": "a,b"}
+	for k, v := range values {
+		if err := cfg.Set(k, v, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	zoo.Set("animal", "lion", "")
+	zoo.Set("count", "3", "")
+	farm.Set("owner", "Donald", "")
+	farm.Set("open", "false", "")
+
+	golden, err := ioutil.ReadFile(filepath.Join("testdata", "write_config.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("testapp%d.conf", i))
+		if err := cfg.WriteConfigFile(path, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(golden) {
+			t.Fatalf("save #%d: WriteConfigFile wrote\n%s\nwant\n%s", i+1, got, golden)
+		}
+	}
+}
+
+func TestSetStrictFiles(t *testing.T) {
+	content := "testapp 0.1\n$name=Mickey\n$removed=x\n$project_removed=y\n$gone_name=z\n"
+
+	newCfg := func() (*Config, StringGetter) {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		name := cfg.NewString("name", "the name")
+		cfg.MustCommand("project", "a project").NewString("title", "the title")
+		return cfg, name
+	}
+
+	oldWarn := Warn
+	var warnings []string
+	Warn = func(msg string) { warnings = append(warnings, msg) }
+	defer func() { Warn = oldWarn }()
+
+	// default: unknown options of the app are ignored, unknown options of commands are errors
+	cfg, name := newCfg()
+	if err := cfg.Merge(strings.NewReader("testapp 0.1\n$name=Mickey\n$removed=x\n"), "test"); err != nil {
+		t.Errorf("default: unexpected error %s", err)
+	}
+	if got, want := name.Get(), "Mickey"; got != want {
+		t.Errorf("default: name = %#v; want %#v", got, want)
+	}
+	if err := cfg.Merge(strings.NewReader(content), "test"); err == nil {
+		t.Errorf("default: expected error for unknown option of command")
+	}
+	if len(warnings) != 0 {
+		t.Errorf("default: unexpected warnings %v", warnings)
+	}
+
+	// strict
+	cfg, _ = newCfg()
+	cfg.SetStrictFiles(true)
+	if err := cfg.Merge(strings.NewReader("testapp 0.1\n$name=Mickey\n$removed=x\n"), "test"); err == nil {
+		t.Errorf("strict: expected error for unknown option")
+	}
+
+	// lenient
+	cfg, name = newCfg()
+	cfg.SetStrictFiles(false)
+	if err := cfg.Merge(strings.NewReader(content), "test"); err != nil {
+		t.Errorf("lenient: unexpected error %s", err)
+	}
+	if got, want := name.Get(), "Mickey"; got != want {
+		t.Errorf("lenient: name = %#v; want %#v", got, want)
+	}
+	if got, want := len(warnings), 3; got != want {
+		t.Errorf("lenient: got %d warnings; want %d: %v", got, want, warnings)
+	}
+}
+
+func TestEmptyValueErrorSource(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("name", "the name")
+
+	err := cfg.Merge(strings.NewReader("testapp 0.1\n$name=\n"), "/etc/testapp.conf")
+	if got, want := err, (EmptyValueSourceError{"name", SourceOther, "/etc/testapp.conf"}); got != want {
+		t.Errorf("Merge() error = %#v; want %#v", got, want)
+	}
+
+	ENV = []string{"TESTAPP_CONFIG_NAME= "}
+	defer func() { ENV = []string{} }()
+
+	err = cfg.MergeEnv()
+	if got, want := err, (EmptyValueSourceError{"name", SourceEnv, "TESTAPP_CONFIG_NAME"}); got != want {
+		t.Errorf("MergeEnv() error = %#v; want %#v", got, want)
+	}
+
+	var empty EmptyValueError
+	if !errors.As(err, &empty) || empty != "name" {
+		t.Errorf("MergeEnv() error = %#v; want to wrap EmptyValueError(%#v)", err, "name")
+	}
+}
+
+func TestMergeCommandFile(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	project := cfg.MustCommand("project", "a project")
+	title := project.NewString("title", "the title")
+
+	if err := project.Merge(strings.NewReader("testapp_project 0.1\n$title=Fantasia\n"), "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := title.Get(), "Fantasia"; got != want {
+		t.Errorf("title = %#v; want %#v", got, want)
+	}
+
+	err := project.Merge(strings.NewReader("testapp 0.1\n$title=Fantasia\n"), "test")
+	if err == nil || !strings.Contains(err.Error(), `expected "testapp_project 0.1"`) {
+		t.Errorf("expected error naming the expected header, got %v", err)
+	}
+
+	if err := cfg.Merge(strings.NewReader("testapp_project 0.1\n$title=Fantasia\n"), "test"); err == nil {
+		t.Errorf("expected error for header of command file in app config")
+	}
+}
+
+func TestRequiredMessage(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("token", "the token", Required, RequiredMessage("set --token or the TESTAPP_CONFIG_TOKEN env variable"))
+
+	ENV = []string{}
+	ARGS = []string{}
+
+	err := cfg.Load(true)
+	if _, is := err.(MissingOptionError); !is {
+		t.Fatalf("expected MissingOptionError, got %#v", err)
+	}
+
+	if got, want := err.Error(), "required option --token not set: set --token or the TESTAPP_CONFIG_TOKEN env variable"; got != want {
+		t.Errorf("err.Error() = %#v; want %#v", got, want)
+	}
+}
+
+func TestSetIntrospectionFlags(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("name", "the name")
+	cfg.SetIntrospectionFlags(false)
+
+	for flag := range IntrospectionFlags {
+		if strings.Contains(cfg.Usage(), "--"+flag) {
+			t.Errorf("usage contains disabled flag --%s", flag)
+		}
+
+		// does not print and exit, but fails as unknown option
+		if _, err := cfg.mergeArgs(false, []string{"--" + flag}, map[string]bool{}, map[string]bool{}); err == nil {
+			t.Errorf("expected error for disabled flag --%s", flag)
+		}
+	}
+
+	cfg.SetIntrospectionFlags(true, "config-spec")
+
+	if !strings.Contains(cfg.Usage(), "--config-spec") {
+		t.Errorf("usage does not contain enabled flag --config-spec")
+	}
+
+	if strings.Contains(cfg.Usage(), "--config-files") {
+		t.Errorf("usage contains disabled flag --config-files")
+	}
+}
+
+func TestSetInterpolation(t *testing.T) {
+	newCfg := func() (*Config, StringGetter, StringGetter, StringGetter) {
+		cfg := MustNew("testapp", "0.1", "a testapp").SetInterpolation(true)
+		basedir := cfg.NewString("basedir", "the base dir")
+		logdir := cfg.NewPath("logdir", "the log dir")
+		logfile := cfg.NewString("logfile", "the log file")
+		cfg.NewInt32("port", "the port")
+		return cfg, basedir, logdir, logfile
+	}
+
+	cfg, basedir, logdir, logfile := newCfg()
+	err := cfg.Merge(strings.NewReader("testapp 0.1\n$basedir=/opt/app\n$logdir=${basedir}/logs\n$logfile=${logdir}/app-${port}.log\n$port=8080\n"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfg.resolveReferences(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := basedir.Get(), "/opt/app"; got != want {
+		t.Errorf("basedir = %#v; want %#v", got, want)
+	}
+
+	if got, want := logdir.Get(), "/opt/app/logs"; got != want {
+		t.Errorf("logdir = %#v; want %#v", got, want)
+	}
+
+	if got, want := logfile.Get(), "/opt/app/logs/app-8080.log"; got != want {
+		t.Errorf("logfile = %#v; want %#v", got, want)
+	}
+
+	cfg, _, _, _ = newCfg()
+	cfg.Merge(strings.NewReader("testapp 0.1\n$basedir=${logfile}\n$logfile=${basedir}\n"), "test")
+	if _, is := cfg.resolveReferences().(ReferenceCycleError); !is {
+		t.Errorf("expected ReferenceCycleError")
+	}
+
+	cfg, _, _, _ = newCfg()
+	cfg.Merge(strings.NewReader("testapp 0.1\n$logfile=${basedir}/app.log\n"), "test")
+	if got, want := cfg.resolveReferences(), (UndefinedReferenceError{"logfile", "basedir"}); got != want {
+		t.Errorf("resolveReferences() = %#v; want %#v", got, want)
+	}
+
+	// references are kept without interpolation
+	cfg, _, _, logfile = newCfg()
+	cfg.SetInterpolation(false)
+	cfg.Merge(strings.NewReader("testapp 0.1\n$logfile=${basedir}/app.log\n"), "test")
+	if err := cfg.resolveReferences(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := logfile.Get(), "${basedir}/app.log"; got != want {
+		t.Errorf("logfile = %#v; want %#v", got, want)
+	}
+
+	// text that is no reference to an option is kept
+	cfg, _, _, logfile = newCfg()
+	cfg.Merge(strings.NewReader("testapp 0.1\n$basedir=/opt/app\n$logfile=${basedir}/${a_b}.log\n"), "test")
+	if err := cfg.resolveReferences(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := logfile.Get(), "/opt/app/${a_b}.log"; got != want {
+		t.Errorf("logfile = %#v; want %#v", got, want)
+	}
+}
+
+func TestWriteShellExports(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("name", "the name")
+	cfg.NewInt32("age", "the age")
+	cfg.NewList("tags", "the tags")
+	project := cfg.MustCommand("project", "a project")
+	project.NewBool("active", "is active")
+
+	cfg.Set("name", "Mickey's house", "")
+	cfg.Set("age", "42", "")
+	cfg.Set("tags", "a,b", "")
+	project.Set("active", "true", "")
+
+	var bf bytes.Buffer
+	if err := cfg.WriteShellExports(&bf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `export TESTAPP_CONFIG_AGE='42'
+export TESTAPP_CONFIG_NAME='Mickey'\''s house'
+export TESTAPP_CONFIG_TAGS='a,b'
+export TESTAPP_PROJECT_CONFIG_ACTIVE='true'
+`
+	if got := bf.String(); got != want {
+		t.Errorf("WriteShellExports() = \n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestOptionNames(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	name := cfg.MustNewOption("name", "string", "the name", nil)
+	project := cfg.MustCommand("project", "a project")
+	title := project.MustNewOption("title", "string", "the title", nil)
+
+	if got, want := name.EnvName("testapp"), "TESTAPP_CONFIG_NAME"; got != want {
+		t.Errorf("EnvName() = %#v; want %#v", got, want)
+	}
+
+	if got, want := title.EnvName("testapp_project"), "TESTAPP_PROJECT_CONFIG_TITLE"; got != want {
+		t.Errorf("EnvName() = %#v; want %#v", got, want)
+	}
+
+	if got, want := name.FlagName(), "--name"; got != want {
+		t.Errorf("FlagName() = %#v; want %#v", got, want)
+	}
+
+	// MergeEnv accepts the env name
+	ENV = []string{title.EnvName("testapp_project") + "=Fantasia"}
+	defer func() { ENV = []string{} }()
+	if err := project.MergeEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := project.GetString("title"), "Fantasia"; got != want {
+		t.Errorf("title = %#v; want %#v", got, want)
+	}
+}
+
+func TestDefaultFromEnv(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	editor := cfg.NewString("editor", "the editor", DefaultFromEnv("EDITOR", "vi"))
+	width := cfg.NewInt32("width", "the width", DefaultFromEnv("COLUMNS", nil))
+
+	ENV = []string{}
+	defer func() { ENV = []string{} }()
+
+	cfg.LoadDefaults()
+
+	if got, want := editor.Get(), "vi"; got != want {
+		t.Errorf("editor = %#v; want %#v", got, want)
+	}
+
+	if width.IsSet() {
+		t.Errorf("width should not be set")
+	}
+
+	ENV = []string{"EDITOR=emacs", "COLUMNS=120"}
+	cfg.Reset()
+	cfg.LoadDefaults()
+
+	if got, want := editor.Get(), "emacs"; got != want {
+		t.Errorf("editor = %#v; want %#v", got, want)
+	}
+
+	if got, want := width.Get(), int32(120); got != want {
+		t.Errorf("width = %v; want %v", got, want)
+	}
+
+	if got, want := cfg.SourceOf("width"), SourceDefaults; got != want {
+		t.Errorf("SourceOf(width) = %#v; want %#v", got, want)
+	}
+}
+
+func TestMergeJSON(t *testing.T) {
+	newCfg := func() (*Config, *Config) {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		cfg.NewString("name", "the name")
+		cfg.NewInt32("age", "the age")
+		cfg.NewBool("active", "is active")
+		cfg.NewList("tags", "the tags")
+		cfg.NewJSON("data", "the data")
+		project := cfg.MustCommand("project", "a project")
+		project.NewString("title", "the title")
+		return cfg, project
+	}
+
+	cfg, project := newCfg()
+	blob := `{"name": "Mickey", "age": 42, "active": true, "tags": ["a", "b"], "data": {"x": [1, 2]}, "unknown": 1, "project": {"title": "Fantasia"}}`
+	if err := cfg.MergeJSON(strings.NewReader(blob), "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := cfg.GetString("name"), "Mickey"; got != want {
+		t.Errorf("name = %#v; want %#v", got, want)
+	}
+	if got, want := cfg.GetInt32("age"), int32(42); got != want {
+		t.Errorf("age = %v; want %v", got, want)
+	}
+	if got, want := cfg.GetBool("active"), true; got != want {
+		t.Errorf("active = %v; want %v", got, want)
+	}
+	if got, want := cfg.GetList("tags"), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tags = %#v; want %#v", got, want)
+	}
+	if got, want := cfg.GetValue("data"), `{"x":[1,2]}`; got != want {
+		t.Errorf("data = %#v; want %#v", got, want)
+	}
+	if got, want := project.GetString("title"), "Fantasia"; got != want {
+		t.Errorf("title = %#v; want %#v", got, want)
+	}
+
+	invalid := []string{
+		`{"age": "old"}`,
+		`{"age": 1.5}`,
+		`{"name": {"first": "Mickey"}}`,
+		`{"project": {"unknown": "x"}}`,
+		`["name"]`,
+	}
+
+	for _, blob := range invalid {
+		cfg, _ := newCfg()
+		if err := cfg.MergeJSON(strings.NewReader(blob), "test"); err == nil {
+			t.Errorf("MergeJSON(%s) = nil; want error", blob)
+		}
+	}
+
+	cfg, _ = newCfg()
+	cfg.SetStrictFiles(true)
+	if err := cfg.MergeJSON(strings.NewReader(`{"unknown": 1}`), "test"); err == nil {
+		t.Errorf("expected error for unknown key in strict mode")
+	}
+}
+
+func TestConfigJSONArg(t *testing.T) {
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		name := cfg.NewString("name", "the name")
+		city := cfg.NewString("city", "the city")
+
+		oldStdin := STDIN
+		defer func() { STDIN = oldStdin }()
+		STDIN = strings.NewReader(`{"name": "Mickey", "city": "Duckburg"}`)
+		ENV = []string{"TESTAPP_CONFIG_NAME=Donald"}
+		ARGS = []string{"--config-json=-", "--city=Mousetown"}
+		defer func() {
+			ENV = []string{}
+			ARGS = []string{}
+		}()
+
+		if err := cfg.Load(true); err != nil {
+			t.Fatal(err)
+		}
+
+		// after env, before args
+		if got, want := name.Get(), "Mickey"; got != want {
+			t.Errorf("name = %#v; want %#v", got, want)
+		}
+
+		if got, want := city.Get(), "Mousetown"; got != want {
+			t.Errorf("city = %#v; want %#v", got, want)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeBlankLinesAroundValues(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	message := cfg.NewString("message", "the message")
+	name := cfg.NewString("name", "the name")
+
+	content := "testapp 0.1\n\n$message=\n\nDear Mickey,\n# a comment inside the value is ignored\n\nsee you\n\n\n$name=Donald\n\n"
+	if err := cfg.Merge(strings.NewReader(content), "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := message.Get(), "Dear Mickey,\n\nsee you"; got != want {
+		t.Errorf("message = %#v; want %#v", got, want)
+	}
+
+	if got, want := name.Get(), "Donald"; got != want {
+		t.Errorf("name = %#v; want %#v", got, want)
+	}
+}
+
+func TestMergeDuplicateKey(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("name", "the name")
+
+	err := cfg.Merge(strings.NewReader("testapp 0.1\n$name=Mickey\n# comment\n$name=Minnie\n"), "/tmp/testapp.conf")
+
+	fileErr, is := err.(InvalidConfigFileError)
+	if !is {
+		t.Fatalf("expected InvalidConfigFileError, got %#v", err)
+	}
+
+	if got, want := fileErr.ConfigFile, "/tmp/testapp.conf"; got != want {
+		t.Errorf("ConfigFile = %#v; want %#v", got, want)
+	}
+
+	if got, want := fileErr.Err, (DuplicateKeyError{"name", 4, 2}); got != want {
+		t.Errorf("Err = %#v; want %#v", got, want)
+	}
+}
+
+func TestAddOptions(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+
+	err := cfg.AddOptions([]Option{
+		{Name: "name", Type: "string", Help: "the name", Shortflag: "n", AltNames: []string{"title"}},
+		{Name: "age", Type: "int32", Help: "the age", Default: int32(3)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cfg.mergeArgs(false, []string{"-n=Mickey"}, map[string]bool{}, map[string]bool{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := cfg.GetString("name"), "Mickey"; got != want {
+		t.Errorf("name = %#v; want %#v", got, want)
+	}
+
+	invalid := [][]Option{
+		{{Name: "name", Type: "string", Help: "another name"}},
+		{{Name: "other", Type: "string", Help: "other", Shortflag: "n"}},
+		{{Name: "title", Type: "string", Help: "the title"}},
+		{{Name: "x", Type: "string", Help: "invalid name"}},
+		{{Name: "weight", Type: "weight", Help: "invalid type"}},
+	}
+
+	for _, opts := range invalid {
+		if err := cfg.AddOptions(opts); err == nil {
+			t.Errorf("AddOptions(%v) = nil; want error", opts[0].Name)
+		}
+	}
+}
+
+func TestAddOptionsFromJSON(t *testing.T) {
+	spec := `[
+		{"name": "port", "type": "int32", "help": "the port", "default": 8080},
+		{"name": "ratio", "type": "float32", "help": "the ratio", "default": 0.5},
+		{"name": "birthday", "type": "date", "help": "the birthday", "default": "2014-12-24T00:00:00Z"},
+		{"name": "tags", "type": "list", "help": "the tags", "default": ["a", "b"]}
+	]`
+
+	var opts []Option
+	if err := json.Unmarshal([]byte(spec), &opts); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	if err := cfg.AddOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	cfg.LoadDefaults()
+
+	if got, want := cfg.GetInt32("port"), int32(8080); got != want {
+		t.Errorf("port = %#v; want %#v", got, want)
+	}
+
+	if got, want := cfg.GetFloat32("ratio"), float32(0.5); got != want {
+		t.Errorf("ratio = %#v; want %#v", got, want)
+	}
+
+	if got, want := cfg.GetTime("birthday"), time.Date(2014, 12, 24, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("birthday = %v; want %v", got, want)
+	}
+
+	if got, want := cfg.GetList("tags"), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tags = %#v; want %#v", got, want)
+	}
+
+	if err := json.Unmarshal([]byte(`[{"name": "size", "type": "int32", "help": "the size", "default": 1.5}]`), &opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfg.AddOptions(opts); err == nil {
+		t.Errorf("AddOptions with fractional int32 default = nil; want error")
+	}
+}
+
+// TestBridgeSpec loads a spec the way cmd/config does for bridged binaries
+func TestBridgeSpec(t *testing.T) {
+	birthday := time.Date(2014, 12, 24, 0, 0, 0, 0, time.UTC)
+	orig := MustNew("testapp", "0.1", "a testapp")
+	orig.NewInt32("port", "the port", Default(int32(8080)), Shortflag('p'))
+	orig.NewFloat32("ratio", "the ratio", Default(float32(0.5)))
+	orig.NewDate("birthday", "the birthday", Default(birthday))
+	orig.NewList("tags", "the tags", Default([]string{"a", "b"}))
+	orig.NewBinary("key", "the key", Default([]byte{0, 1}))
+
+	data, err := orig.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	if err := cfg.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if !orig.SpecEqual(cfg) {
+		t.Errorf("SpecEqual() = false; want true for bridged spec")
+	}
+
+	cfg.LoadDefaults()
+
+	if got, want := cfg.GetValue("port"), interface{}(int32(8080)); got != want {
+		t.Errorf("port = %#v; want %#v", got, want)
+	}
+
+	if got, want := cfg.GetValue("ratio"), interface{}(float32(0.5)); got != want {
+		t.Errorf("ratio = %#v; want %#v", got, want)
+	}
+
+	if got := cfg.GetTime("birthday"); !got.Equal(birthday) {
+		t.Errorf("birthday = %v; want %v", got, birthday)
+	}
+
+	if _, err := cfg.mergeArgs(false, []string{"-p=3000"}, map[string]bool{}, map[string]bool{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := cfg.GetInt32("port"), int32(3000); got != want {
+		t.Errorf("port = %v; want %v", got, want)
+	}
+
+	invalid := `{"port": {"name": "port", "type": "int32", "help": "the port", "default": 1.5}}`
+	if err := MustNew("testapp", "0.1", "a testapp").UnmarshalJSON([]byte(invalid)); err == nil {
+		t.Errorf("UnmarshalJSON() = nil; want error for invalid int32 default")
+	}
+}
+
+func TestSetFileReferences(t *testing.T) {
+	newCfg := func() (*Config, *Config) {
+		cfg := MustNew("testapp", "0.1", "a testapp").SetFileReferences(true)
+		cfg.NewString("host", "the host")
+		cfg.NewInt32("port", "the port")
+		cfg.NewString("baseurl", "the base url")
+		project := cfg.MustCommand("project", "a project")
+		project.NewString("title", "the title")
+		project.NewString("url", "the url")
+		return cfg, project
+	}
+
+	cfg, project := newCfg()
+	content := "testapp 0.1\n$host=localhost\n$port=8080\n$baseurl=http://${host}:${port}\n$project_title=fantasia\n$project_url=${baseurl}/${project_title}\n"
+	if err := cfg.Merge(strings.NewReader(content), "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := cfg.GetString("baseurl"), "http://localhost:8080"; got != want {
+		t.Errorf("baseurl = %#v; want %#v", got, want)
+	}
+
+	if got, want := project.GetString("url"), "http://localhost:8080/fantasia"; got != want {
+		t.Errorf("url = %#v; want %#v", got, want)
+	}
+
+	invalid := []string{
+		// forward reference
+		"testapp 0.1\n$baseurl=http://${host}\n$host=localhost\n",
+		// unknown reference
+		"testapp 0.1\n$baseurl=http://${server}\n",
+	}
+
+	for _, content := range invalid {
+		cfg, _ := newCfg()
+		err := cfg.Merge(strings.NewReader(content), "test")
+		if fileErr, is := err.(InvalidConfigFileError); !is {
+			t.Errorf("Merge(%#v) = %#v; want InvalidConfigFileError", content, err)
+		} else if _, is := fileErr.Err.(UndefinedReferenceError); !is {
+			t.Errorf("Merge(%#v) = %#v; want UndefinedReferenceError", content, fileErr.Err)
+		}
+	}
+
+	// without file references, the value is kept
+	cfg, _ = newCfg()
+	cfg.SetFileReferences(false)
+	if err := cfg.Merge(strings.NewReader("testapp 0.1\n$baseurl=http://${host}\n"), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.GetString("baseurl"), "http://${host}"; got != want {
+		t.Errorf("baseurl = %#v; want %#v", got, want)
+	}
+}
+
+func TestSetActiveCommand(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	project := cfg.MustCommand("project", "a project")
+
+	if err := cfg.SetActiveCommand("Project"); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.ActiveCommand() != project {
+		t.Errorf("ActiveCommand() = %p; want %p", cfg.ActiveCommand(), project)
+	}
+
+	if got, want := cfg.SetActiveCommand("unknown"), UnknownCommandError("unknown"); got != want {
+		t.Errorf("SetActiveCommand(unknown) = %#v; want %#v", got, want)
+	}
+
+	if project.SetActiveCommand("project") == nil {
+		t.Errorf("expected error when called in a command")
+	}
+
+	if err := cfg.SetActiveCommand(""); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.ActiveCommand() != nil {
+		t.Errorf("ActiveCommand() = %p; want nil", cfg.ActiveCommand())
+	}
+}
+
+func TestGetterFromSpec(t *testing.T) {
+	orig := MustNew("testapp", "0.1", "a testapp")
+	orig.NewString("name", "the name")
+	orig.NewInt32("age", "the age")
+	orig.NewDate("birthday", "the birthday")
+
+	data, err := orig.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	if err := cfg.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Set("name", "Mickey", "")
+	cfg.Set("age", "42", "")
+
+	name, err := cfg.StringOption("name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := name.Get(), "Mickey"; got != want {
+		t.Errorf("name = %#v; want %#v", got, want)
+	}
+
+	age, err := cfg.Int32Option("age")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := age.Get(), int32(42); got != want {
+		t.Errorf("age = %v; want %v", got, want)
+	}
+
+	birthday, err := cfg.DateTimeOption("birthday")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if birthday.IsSet() {
+		t.Errorf("birthday should not be set")
+	}
+
+	if _, err := cfg.StringOption("age"); err != (InvalidTypeError{"age", "int32"}) {
+		t.Errorf("StringOption(age) error = %#v; want InvalidTypeError", err)
+	}
+
+	if _, err := cfg.BoolOption("unknown"); err != (UnknownOptionError{"0.1", "unknown"}) {
+		t.Errorf("BoolOption(unknown) error = %#v; want UnknownOptionError", err)
+	}
+}
+
+func TestGetterFromSpecDefaults(t *testing.T) {
+	wakeup := time.Date(0, 1, 1, 7, 30, 0, 0, time.UTC)
+	orig := MustNew("testapp", "0.1", "a testapp")
+	orig.NewInt32("port", "the port", Default(int32(8080)))
+	orig.NewFloat32("ratio", "the ratio", Default(float32(0.5)))
+	orig.NewTime("wakeup", "the wakeup time", Default(wakeup))
+	orig.NewList("tags", "the tags", Default([]string{"a", "b"}))
+
+	data, err := orig.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	if err := cfg.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	cfg.LoadDefaults()
+
+	port, err := cfg.Int32Option("port")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := port.Get(), int32(8080); got != want {
+		t.Errorf("port = %v; want %v", got, want)
+	}
+
+	ratio, err := cfg.Float32Option("ratio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ratio.Get(), float32(0.5); got != want {
+		t.Errorf("ratio = %v; want %v", got, want)
+	}
+
+	wake, err := cfg.DateTimeOption("wakeup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := wake.Get(); !got.Equal(wakeup) {
+		t.Errorf("wakeup = %v; want %v", got, wakeup)
+	}
+
+	tags, err := cfg.ListOption("tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(tags.Get(), ","), "a,b"; got != want {
+		t.Errorf("tags = %#v; want %#v", got, want)
+	}
+}
+
+func TestWriteConfigFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newCfg := func() *Config {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		cfg.NewBool("active", "is active")
+		cfg.NewInt32("age", "the age")
+		cfg.NewFloat32("ratio", "the ratio")
+		cfg.NewString("name", "the name")
+		cfg.NewString("text", "the text")
+		cfg.NewDate("birthday", "the birthday")
+		cfg.NewTime("wakeup", "the wakeup time")
+		cfg.NewDateTime("created", "the creation time")
+		cfg.NewList("tags", "the tags")
+		cfg.NewJSON("data", "the data")
+		cfg.NewBinary("key", "the key")
+		return cfg
+	}
+
+	values := map[string]string{
+		"active":   "true",
+		"age":      "-42",
+		"ratio":    "0.5",
+		"name":     "Mickey",
+		"text":     "a long text\nthat spans\n\nseveral lines",
+		"birthday": "1928-11-18",
+		"wakeup":   "07:30:00",
+		"created":  "2020-01-02 03:04:05",
+		"tags":     "a,b,c",
+		"data":     `{"x":[1,2]}`,
+		"key":      "c2VjcmV0",
+	}
+
+	for _, compact := range []bool{false, true} {
+		cfg := newCfg()
+		for k, v := range values {
+			if err := cfg.Set(k, v, ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		path := filepath.Join(dir, fmt.Sprintf("testapp-%v.conf", compact))
+		write := cfg.WriteConfigFile
+		if compact {
+			write = cfg.WriteConfigFileCompact
+		}
+		if err := write(path, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// POSIX line conventions: LF only and a single final linefeed
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("\r")) {
+			t.Errorf("compact=%v: file contains CR", compact)
+		}
+		if !bytes.HasSuffix(data, []byte("\n")) || bytes.HasSuffix(data, []byte("\n\n")) {
+			t.Errorf("compact=%v: file does not end with a single linefeed: %#v", compact, string(data[len(data)-10:]))
+		}
+
+		loaded := newCfg()
+		if err, _ := loaded.LoadFile(path); err != nil {
+			t.Fatal(err)
+		}
+
+		for k := range values {
+			if got, want := loaded.GetValue(k), cfg.GetValue(k); !reflect.DeepEqual(got, want) {
+				t.Errorf("compact=%v: %s = %#v; want %#v", compact, k, got, want)
+			}
+		}
+	}
+}
+
+func TestShortflagClusters(t *testing.T) {
+	newCfg := func() (*Config, *Config) {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		cfg.NewBool("verbose", "be verbose", Shortflag('v'))
+		tar := cfg.MustCommand("tar", "handle archives")
+		tar.NewBool("extract", "extract the archive", Shortflag('x'))
+		tar.NewBool("gzip", "use gzip", Shortflag('z'))
+		tar.NewString("file", "the archive", Shortflag('f'))
+		return cfg, tar
+	}
+
+	tests := []struct {
+		args    []string
+		verbose bool
+		extract bool
+		gzip    bool
+		file    string
+	}{
+		{[]string{"tar", "-xvf", "archive.tar"}, true, true, false, "archive.tar"},
+		{[]string{"tar", "-xzfarchive.tar.gz"}, false, true, true, "archive.tar.gz"},
+		{[]string{"tar", "-xf=archive.tar", "-v"}, true, true, false, "archive.tar"},
+		{[]string{"tar", "-xz"}, false, true, true, ""},
+	}
+
+	for _, test := range tests {
+		cfg, tar := newCfg()
+		cfg.SetArgs(test.args)
+		if err := cfg.Load(true); err != nil {
+			t.Errorf("Load(%v) returned error %s", test.args, err)
+			continue
+		}
+
+		if got, want := cfg.GetBool("verbose"), test.verbose; got != want {
+			t.Errorf("Load(%v): verbose = %v; want %v", test.args, got, want)
+		}
+		if got, want := tar.GetBool("extract"), test.extract; got != want {
+			t.Errorf("Load(%v): extract = %v; want %v", test.args, got, want)
+		}
+		if got, want := tar.GetBool("gzip"), test.gzip; got != want {
+			t.Errorf("Load(%v): gzip = %v; want %v", test.args, got, want)
+		}
+		if got, want := tar.GetString("file"), test.file; got != want {
+			t.Errorf("Load(%v): file = %#v; want %#v", test.args, got, want)
+		}
+	}
+
+	// missing value of the last shortflag
+	cfg, _ := newCfg()
+	cfg.SetArgs([]string{"tar", "-xf"})
+	if err := cfg.Load(true); err == nil {
+		t.Errorf("expected error for missing value")
+	}
+
+	// single dash args with the name of an option are no clusters
+	cfg = MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("name", "the name", Shortflag('n'))
+	cfg.NewBool("nocache", "don't cache")
+	cfg.SetArgs([]string{"-nocache"})
+	if err := cfg.Load(true); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.GetBool("nocache") || cfg.IsSet("name") {
+		t.Errorf("-nocache: nocache = %v, name = %#v; want nocache to be set", cfg.GetBool("nocache"), cfg.GetString("name"))
+	}
+}
+
+// memFS is an in-memory FileSystem, whose files fail after failAfter writes, if failAfter > 0
+type memFS struct {
+	fstest.MapFS
+	failAfter int
+}
+
+func (m memFS) Open(name string) (io.ReadCloser, error)      { return m.MapFS.Open(name) }
+func (m memFS) Stat(name string) (os.FileInfo, error)        { return fs.Stat(m.MapFS, name) }
+func (m memFS) ReadFile(name string) ([]byte, error)         { return fs.ReadFile(m.MapFS, name) }
+func (m memFS) MkdirAll(path string, perm os.FileMode) error { return nil }
+
+func (m memFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	m.MapFS[name] = &fstest.MapFile{Data: data, Mode: perm}
+	return nil
+}
+
+func (m memFS) Remove(name string) error {
+	if _, has := m.MapFS[name]; !has {
+		return os.ErrNotExist
+	}
+	delete(m.MapFS, name)
+	return nil
+}
+
+func (m memFS) OpenFile(name string, flag int, perm os.FileMode) (WritableFile, error) {
+	m.MapFS[name] = &fstest.MapFile{Mode: perm}
+	return &memFile{fsys: m, name: name}, nil
+}
+
+type memFile struct {
+	fsys   memFS
+	name   string
+	writes int
+}
+
+func (f *memFile) WriteString(s string) (int, error) {
+	f.writes++
+	if f.fsys.failAfter > 0 && f.writes > f.fsys.failAfter {
+		return 0, errors.New("disk full")
+	}
+	f.fsys.MapFS[f.name].Data = append(f.fsys.MapFS[f.name].Data, s...)
+	return len(s), nil
+}
+
+func (f *memFile) Close() error { return nil }
+
+func TestSetFileSystem(t *testing.T) {
+	path := "etc/testapp/testapp.conf"
+	fsys := memFS{MapFS: fstest.MapFS{}}
+
+	cfg := MustNew("testapp", "0.1", "a testapp").SetFileSystem(fsys)
+	name := cfg.NewString("name", "the name")
+	cfg.Set("name", "Mickey", "")
+	if err := cfg.WriteConfigFile(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Reset()
+	err, found := cfg.LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatalf("config file %s not found in filesystem", path)
+	}
+
+	if got, want := name.Get(), "Mickey"; got != want {
+		t.Errorf("name = %#v; want %#v", got, want)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("config file %s must not be written to the real filesystem", path)
+	}
+}
+
+func TestWriteConfigFileTo(t *testing.T) {
+	path := "etc/testapp/testapp.conf"
+	newCfg := func() *Config {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		cfg.NewString("name", "the name")
+		cfg.NewInt32("age", "the age")
+		return cfg
+	}
+
+	// new file
+	fsys := memFS{MapFS: fstest.MapFS{}}
+	cfg := newCfg()
+	cfg.Set("name", "Mickey", "")
+	if err := cfg.WriteConfigFileTo(fsys, path, 0640); err != nil {
+		t.Fatalf("WriteConfigFileTo returned error: %s", err)
+	}
+	if got, want := fsys.MapFS[path].Mode, os.FileMode(0640); got != want {
+		t.Errorf("mode = %v; want %v", got, want)
+	}
+	written := string(fsys.MapFS[path].Data)
+	if !strings.HasPrefix(written, "testapp 0.1\n") || !strings.Contains(written, "$name=Mickey") {
+		t.Errorf("unexpected content:\n%s", written)
+	}
+
+	// failing write restores the backup
+	fsys = memFS{MapFS: fstest.MapFS{path: &fstest.MapFile{Data: []byte("testapp 0.1\n$name=Donald"), Mode: 0600}}, failAfter: 2}
+	cfg = newCfg()
+	cfg.Set("name", "Mickey", "")
+	cfg.Set("age", "42", "")
+	if err := cfg.WriteConfigFileTo(fsys, path, 0644); err == nil || err.Error() != "disk full" {
+		t.Errorf("WriteConfigFileTo returned error %v; want disk full", err)
+	}
+	if got, want := string(fsys.MapFS[path].Data), "testapp 0.1\n$name=Donald"; got != want {
+		t.Errorf("content after failed write = %#v; want %#v", got, want)
+	}
+	if got, want := fsys.MapFS[path].Mode, os.FileMode(0600); got != want {
+		t.Errorf("mode after failed write = %v; want %v", got, want)
+	}
+
+	// no values removes the file
+	fsys = memFS{MapFS: fstest.MapFS{path: &fstest.MapFile{Data: []byte("testapp 0.1\n$name=Donald")}}}
+	if err := newCfg().WriteConfigFileTo(fsys, path, 0644); err != nil {
+		t.Fatalf("WriteConfigFileTo returned error: %s", err)
+	}
+	if _, has := fsys.MapFS[path]; has {
+		t.Errorf("file %s should have been removed", path)
+	}
+
+	// the parent is no directory
+	fsys = memFS{MapFS: fstest.MapFS{"etc/testapp": &fstest.MapFile{Data: []byte("x")}}}
+	cfg = newCfg()
+	cfg.Set("name", "Mickey", "")
+	if err := cfg.WriteConfigFileTo(fsys, path, 0644); err == nil {
+		t.Errorf("expected error, if the parent is no directory")
+	}
+}
+
+func TestVersionJSON(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	sub := cfg.MustCommand("sub", "a sub command")
+	sub.SetBuildInfo(map[string]string{"commit": "abc123", "date": "2020-01-02", "version": "ignored"})
+
+	for _, c := range []*Config{cfg, sub} {
+		bt, err := c.VersionJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got map[string]string
+		if err := json.Unmarshal(bt, &got); err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{
+			"app":     "testapp",
+			"version": "0.1",
+			"go":      runtime.Version(),
+			"commit":  "abc123",
+			"date":    "2020-01-02",
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("VersionJSON() = %v; want %v", got, want)
+		}
+	}
+}
+
+func TestShortflagSharedWithCommand(t *testing.T) {
+	// parent first
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewBool("verbose", "be verbose", Shortflag('v'))
+	sub := cfg.MustCommand("sub", "a sub command")
+	_, err := sub.NewOption("version", "bool", "show the version", []func(*Option){Shortflag('v')})
+	if _, ok := err.(ErrDoubleShortflag); !ok {
+		t.Errorf("expected ErrDoubleShortflag for command, got %v", err)
+	}
+
+	// command first
+	cfg = MustNew("testapp", "0.1", "a testapp")
+	sub = cfg.MustCommand("sub", "a sub command")
+	sub.NewBool("version", "show the version", Shortflag('v'))
+	_, err = cfg.NewOption("verbose", "bool", "be verbose", []func(*Option){Shortflag('v')})
+	if _, ok := err.(ErrDoubleShortflag); !ok {
+		t.Errorf("expected ErrDoubleShortflag for parent, got %v", err)
+	}
+
+	// different commands may share a shortflag, since only one of them is active
+	cfg = MustNew("testapp", "0.1", "a testapp")
+	a := cfg.MustCommand("build", "builds")
+	b := cfg.MustCommand("clean", "cleans")
+	a.NewBool("verbose", "be verbose", Shortflag('v'))
+	if _, err := b.NewOption("verbose", "bool", "be verbose", []func(*Option){Shortflag('v')}); err != nil {
+		t.Errorf("expected no error for shortflag of sibling command, got %v", err)
+	}
+}
+
+func TestSetLenientValues(t *testing.T) {
+	newCfg := func() (*Config, Int32Getter, Int32Getter) {
+		cfg := MustNew("testapp", "0.2", "a testapp")
+		age := cfg.NewInt32("age", "the age")
+		size := cfg.MustCommand("project", "a project").NewInt32("size", "the size")
+		return cfg, age, size
+	}
+
+	oldWarn := Warn
+	var warnings []string
+	Warn = func(msg string) { warnings = append(warnings, msg) }
+	defer func() { Warn = oldWarn }()
+
+	old := "testapp 0.1\n$age=forty\n$project_size=12\n"
+
+	// default: the invalid value fails the whole file
+	cfg, _, _ := newCfg()
+	if err := cfg.Merge(strings.NewReader(old), "old.conf"); err == nil {
+		t.Errorf("default: expected error for invalid value")
+	}
+
+	cfg, age, size := newCfg()
+	cfg.SetLenientValues(true)
+	if err := cfg.Merge(strings.NewReader(old), "old.conf"); err != nil {
+		t.Fatalf("lenient: unexpected error %s", err)
+	}
+	if got, want := size.Get(), int32(12); got != want {
+		t.Errorf("lenient: size = %v; want %v", got, want)
+	}
+	if age.IsSet() {
+		t.Errorf("lenient: age should not be set")
+	}
+	if err := cfg.Merge(strings.NewReader("testapp 0.2\n$project_size=big\n"), "new.conf"); err != nil {
+		t.Fatalf("lenient: unexpected error %s", err)
+	}
+
+	skipped := cfg.LoadReport().Skipped
+	if len(skipped) != 2 {
+		t.Fatalf("lenient: got %d skipped values; want 2: %v", len(skipped), skipped)
+	}
+	if got, want := skipped[0], (SkippedValue{"age", "forty", "old.conf", "0.1", true, skipped[0].Err}); !reflect.DeepEqual(got, want) {
+		t.Errorf("skipped[0] = %#v; want %#v", got, want)
+	}
+	if got, want := skipped[1], (SkippedValue{"project_size", "big", "new.conf", "0.2", false, skipped[1].Err}); !reflect.DeepEqual(got, want) {
+		t.Errorf("skipped[1] = %#v; want %#v", got, want)
+	}
+	if len(warnings) != 2 {
+		t.Errorf("lenient: got %d warnings; want 2: %v", len(warnings), warnings)
+	}
+
+	// syntax errors still fail
+	if err := cfg.Merge(strings.NewReader("testapp 0.1\n$=x\n"), "broken.conf"); err == nil {
+		t.Errorf("lenient: expected error for syntax error")
+	}
+
+	cfg.Reset()
+	if got := cfg.LoadReport().Skipped; len(got) != 0 {
+		t.Errorf("after Reset: skipped = %v; want none", got)
+	}
+
+	// called on a command, the app is lenient too and the command reports the app's skipped values
+	cfg, _, _ = newCfg()
+	project := cfg.commands["project"]
+	project.SetLenientValues(true)
+	if err := cfg.Merge(strings.NewReader(old), "old.conf"); err != nil {
+		t.Fatalf("lenient via command: unexpected error %s", err)
+	}
+	if got := project.LoadReport().Skipped; len(got) != 1 || got[0].Option != "age" {
+		t.Errorf("lenient via command: skipped = %v; want age", got)
+	}
+}
+
+func TestInheritToSubs(t *testing.T) {
+	newCfg := func() (*Config, *Config) {
+		cfg := MustNew("testapp", "0.1", "a testapp")
+		cfg.NewBool("verbose", "be verbose")
+		cfg.NewString("name", "the name")
+		sub := cfg.MustCommand("sub", "a sub command")
+		sub.NewBool("verbose", "be verbose inside sub", Default(false))
+		sub.NewString("name", "the name inside sub")
+		return cfg, sub
+	}
+
+	tests := []struct {
+		inherit []string
+		file    string
+		args    []string
+		verbose bool
+		name    string
+	}{
+		// not inherited: the option of the command hides the app's value
+		{nil, "testapp 0.1\n$verbose=true\n$name=app", []string{"sub"}, false, ""},
+		{[]string{}, "testapp 0.1\n$verbose=true\n$name=app", []string{"sub"}, true, "app"},
+		{[]string{"verbose"}, "testapp 0.1\n$verbose=true\n$name=app", []string{"sub"}, true, ""},
+		// explicit values of the command win
+		{[]string{}, "testapp 0.1\n$verbose=true\n$name=app\n$sub_name=sub", []string{"sub"}, true, "sub"},
+		{[]string{}, "testapp 0.1\n$verbose=true\n$sub_verbose=false", []string{"sub"}, false, ""},
+		{[]string{}, "testapp 0.1\n$name=app", []string{"sub", "--name=arg"}, false, "arg"},
+	}
+
+	for i, test := range tests {
+		err := withTempConfig(func() {
+			cfg, sub := newCfg()
+			if test.inherit != nil {
+				cfg.InheritToSubs(test.inherit...)
+			}
+			os.MkdirAll(filepath.Dir(cfg.LocalFile()), 0755)
+			if err := ioutil.WriteFile(cfg.LocalFile(), []byte(test.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg.SetArgs(test.args)
+			if err := cfg.Load(true); err != nil {
+				t.Errorf("[%d] Load returned error %s", i, err)
+				return
+			}
+			if got, want := sub.GetBool("verbose"), test.verbose; got != want {
+				t.Errorf("[%d] verbose = %v; want %v", i, got, want)
+			}
+			if got, want := sub.GetString("name"), test.name; got != want {
+				t.Errorf("[%d] name = %#v; want %#v", i, got, want)
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// negative defaults of the command are no explicit values
+	err := withTempConfig(func() {
+		cfg := MustNew("testapp", "0.1", "a testapp").InheritToSubs()
+		cfg.NewInt32("level", "the level")
+		sub := cfg.MustCommand("sub", "a sub command")
+		sub.NewInt32("level", "the level inside sub", Default(int32(-1)))
+		ENV = []string{"TESTAPP_CONFIG_LEVEL=5"}
+		defer func() { ENV = []string{} }()
+		cfg.SetArgs([]string{"sub"})
+		if err := cfg.Load(true); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := sub.GetInt32("level"), int32(5); got != want {
+			t.Errorf("level = %v; want %v", got, want)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// types must match
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewBool("verbose", "be verbose")
+	cfg.MustCommand("sub", "a sub command").NewInt32("verbose", "the verbosity")
+	cfg.InheritToSubs("verbose")
+	cfg.SetArgs([]string{"sub"})
+	if err := cfg.Load(true); err == nil {
+		t.Errorf("expected error for different types")
+	}
+}
+
+func TestWriteCompact(t *testing.T) {
+	cfg := MustNew("testapp", "0.1", "a testapp")
+	cfg.NewBool("active", "is active")
+	cfg.NewString("name", "the name")
+	cfg.NewString("text", "the text")
+	cfg.NewString("password", "the password", Secret)
+	cfg.NewDateTime("created", "the creation time")
+	cfg.NewJSON("data", "the data")
+	cfg.NewList("tags", "the tags")
+	sub := cfg.MustCommand("sub", "a sub command")
+	sub.NewInt32("count", "the count")
+
+	values := map[string]string{
+		"active":   "true",
+		"name":     "Mickey Mouse",
+		"text":     "it's\nmultiline",
+		"password": "secret",
+		"created":  "2020-01-02 03:04:05",
+		"data":     "{\n  \"x\": [1, 2]\n}",
+		"tags":     "a,b",
+	}
+	for k, v := range values {
+		if err := cfg.Set(k, v, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sub.Set("count", "3", "")
+
+	var bf bytes.Buffer
+	if err := cfg.WriteCompact(&bf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `active=true created=2020-01-02T03:04:05Z data='{"x":[1,2]}' name='Mickey Mouse' password='***' tags=a,b text=$'it\'s\nmultiline' sub_count=3`
+	if got := bf.String(); got != want {
+		t.Errorf("WriteCompact() = %s; want %s", got, want)
+	}
+}
@@ -0,0 +1,95 @@
+// Package configtest provides helpers for testing programs that use config,
+// e.g. to assert that an env variable overrides the user config file.
+package configtest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/metakeule/config"
+)
+
+// TempDirs sets the global, user, runtime and working dir to temporary directories
+// and clears the env variables and args. Everything is restored when the test ends.
+func TempDirs(t testing.TB) {
+	t.Helper()
+	userDir, globalDirs, workingDir, runtimeDir := config.USER_DIR, config.GLOBAL_DIRS, config.WORKING_DIR, config.RUNTIME_DIR
+	env, args := config.ENV, config.ARGS
+	t.Cleanup(func() {
+		config.USER_DIR, config.GLOBAL_DIRS, config.WORKING_DIR, config.RUNTIME_DIR = userDir, globalDirs, workingDir, runtimeDir
+		config.ENV, config.ARGS = env, args
+	})
+
+	dir := t.TempDir()
+	config.USER_DIR = filepath.Join(dir, "user")
+	config.GLOBAL_DIRS = filepath.Join(dir, "global")
+	config.WORKING_DIR = filepath.Join(dir, "working")
+	config.RUNTIME_DIR = filepath.Join(dir, "runtime")
+	config.ENV = []string{}
+	config.ARGS = []string{}
+}
+
+// SetLayer sets the given values (option => value) for the given source, so that they
+// are loaded by the next Load. For files (globals, user, runtime and locals) the config file is
+// written. For env and args, the values are added to config.ENV and config.ARGS.
+// Options of commands must be given as [command]_[option] (not supported for args).
+// Use TempDirs before, to not touch the real config files.
+func SetLayer(t testing.TB, c *config.Config, src config.Source, values map[string]string) {
+	t.Helper()
+	switch src {
+	case config.SourceGlobals:
+		writeFile(t, c, c.FirstGlobalsFile(), values)
+	case config.SourceUser:
+		writeFile(t, c, c.UserFile(), values)
+	case config.SourceRuntime:
+		writeFile(t, c, c.RuntimeFile(), values)
+	case config.SourceLocals:
+		writeFile(t, c, c.LocalFile(), values)
+	case config.SourceEnv:
+		for option, value := range values {
+			prefix := c.AppName() + "_CONFIG_"
+			if idx := strings.Index(option, "_"); idx > 0 {
+				prefix = c.AppName() + "_" + option[:idx] + "_CONFIG_"
+				option = option[idx+1:]
+			}
+			config.ENV = append(config.ENV, strings.ToUpper(prefix+option)+"="+value)
+		}
+	case config.SourceArgs:
+		for option, value := range values {
+			config.ARGS = append(config.ARGS, "--"+option+"="+value)
+		}
+	default:
+		t.Fatalf("can't set layer for source %#v", src)
+	}
+}
+
+// writeFile writes a config file with the given values to path
+func writeFile(t testing.TB, c *config.Config, path string, values map[string]string) {
+	t.Helper()
+	if path == "" {
+		t.Fatalf("no config file path for app %s", c.AppName())
+	}
+	var bf strings.Builder
+	bf.WriteString(c.AppName() + " " + c.Version() + "\n")
+	for option, value := range values {
+		bf.WriteString(config.OPTION_PREFIX + option + "=" + value + "\n")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("can't create dir for config file %s: %s", path, err)
+	}
+	if err := ioutil.WriteFile(path, []byte(bf.String()), 0644); err != nil {
+		t.Fatalf("can't write config file %s: %s", path, err)
+	}
+}
+
+// AssertSource fails the test, if the current value of the option does not come
+// from the expected source (see config.Config.SourceOf)
+func AssertSource(t testing.TB, c *config.Config, option string, expected config.Source) {
+	t.Helper()
+	if got := c.SourceOf(option); got != expected {
+		t.Errorf("source of option %s is %#v; want %#v (locations: %v)", option, got, expected, c.Locations(option))
+	}
+}
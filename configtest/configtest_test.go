@@ -0,0 +1,77 @@
+package configtest_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/metakeule/config"
+	"github.com/metakeule/config/configtest"
+)
+
+func TestAssertSource(t *testing.T) {
+	configtest.TempDirs(t)
+
+	cfg := config.MustNew("testapp", "0.1", "a testapp")
+	cfg.NewString("name", "the name", config.Default("Minnie"))
+	cfg.NewString("city", "the city")
+	cfg.NewString("street", "the street")
+	cfg.NewString("house", "the house")
+	cfg.NewInt32("offset", "the offset", config.Default(int32(-5)))
+
+	configtest.SetLayer(t, cfg, config.SourceGlobals, map[string]string{"house": "1"})
+	configtest.SetLayer(t, cfg, config.SourceUser, map[string]string{"city": "Duckburg", "street": "Main Street"})
+	configtest.SetLayer(t, cfg, config.SourceLocals, map[string]string{"street": "Side Street"})
+	configtest.SetLayer(t, cfg, config.SourceEnv, map[string]string{"city": "Mousetown"})
+
+	if err := cfg.Load(true); err != nil {
+		t.Fatal(err)
+	}
+
+	configtest.AssertSource(t, cfg, "name", config.SourceDefaults)
+	configtest.AssertSource(t, cfg, "offset", config.SourceDefaults)
+	configtest.AssertSource(t, cfg, "house", config.SourceGlobals)
+	configtest.AssertSource(t, cfg, "city", config.SourceEnv)
+	configtest.AssertSource(t, cfg, "street", config.SourceLocals)
+
+	configtest.SetLayer(t, cfg, config.SourceArgs, map[string]string{"city": "Gotham"})
+
+	if err := cfg.Load(true); err != nil {
+		t.Fatal(err)
+	}
+
+	configtest.AssertSource(t, cfg, "city", config.SourceArgs)
+}
+
+func TestLoad(t *testing.T) {
+	oldArgs, oldEnv := config.ARGS, config.ENV
+
+	cfg := configtest.Load("testapp", "0.1",
+		[]string{"--age=12"},
+		[]string{"TESTAPP_CONFIG_CITY=Mousetown"},
+		map[string]string{
+			"user":  "testapp 0.1\n$name=Minnie\n$city=Duckburg",
+			"local": "testapp 0.1\n$name=Batman",
+		},
+		func(c *config.Config) {
+			c.NewString("name", "the name")
+			c.NewString("city", "the city")
+			c.NewInt32("age", "the age")
+		},
+	)
+
+	if got, want := cfg.GetString("name"), "Batman"; got != want {
+		t.Errorf("name = %#v; want %#v", got, want)
+	}
+
+	if got, want := cfg.GetString("city"), "Mousetown"; got != want {
+		t.Errorf("city = %#v; want %#v", got, want)
+	}
+
+	if got, want := cfg.GetInt32("age"), int32(12); got != want {
+		t.Errorf("age = %v; want %v", got, want)
+	}
+
+	if !reflect.DeepEqual(config.ARGS, oldArgs) || !reflect.DeepEqual(config.ENV, oldEnv) {
+		t.Errorf("ARGS and ENV must not be changed")
+	}
+}
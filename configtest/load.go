@@ -0,0 +1,106 @@
+package configtest
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/metakeule/config"
+)
+
+// Load creates a new config for the given app and version, calls define (if not nil)
+// to define the options and commands and then runs Load with the given args and env
+// variables. The files map the layers "global", "user", "runtime" and "local" to the
+// content of their config files, which are kept in memory (see config.Config.SetFileSystem).
+// Neither the real args, env variables nor the filesystem are used and no package
+// variables are changed, so Load may be used in parallel tests. Load panics on errors.
+func Load(app, version string, args, env []string, files map[string]string, define func(c *config.Config)) *config.Config {
+	c := config.MustNew(app, version, "")
+	if define != nil {
+		define(c)
+	}
+
+	mem := memFiles{}
+	for layer, content := range files {
+		var path string
+		switch layer {
+		case "global":
+			path = c.FirstGlobalsFile()
+		case "user":
+			path = c.UserFile()
+		case "runtime":
+			path = c.RuntimeFile()
+		case "local":
+			path = c.LocalFile()
+		default:
+			panic("unknown layer " + layer + " (valid layers are global, user, runtime and local)")
+		}
+		if path == "" {
+			panic("no config file for layer " + layer)
+		}
+		mem[path] = content
+	}
+
+	c.SetArgs(args).SetEnv(env).SetFileSystem(mem)
+	if err := c.Load(true); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// memFiles is a read-only in-memory config.FileSystem that maps paths to the content of files
+type memFiles map[string]string
+
+var errReadOnly = errors.New("read-only filesystem")
+
+func (m memFiles) Open(name string) (io.ReadCloser, error) {
+	content, has := m[name]
+	if !has {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(strings.NewReader(content)), nil
+}
+
+func (m memFiles) Stat(name string) (os.FileInfo, error) {
+	content, has := m[name]
+	if !has {
+		return nil, os.ErrNotExist
+	}
+	return memFileInfo{filepath.Base(name), int64(len(content))}, nil
+}
+
+func (m memFiles) ReadFile(name string) ([]byte, error) {
+	content, has := m[name]
+	if !has {
+		return nil, os.ErrNotExist
+	}
+	return []byte(content), nil
+}
+
+func (m memFiles) MkdirAll(path string, perm os.FileMode) error { return errReadOnly }
+func (m memFiles) Remove(name string) error                     { return errReadOnly }
+
+func (m memFiles) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return errReadOnly
+}
+
+func (m memFiles) OpenFile(name string, flag int, perm os.FileMode) (config.WritableFile, error) {
+	return nil, errReadOnly
+}
+
+// memFileInfo is the os.FileInfo of a file of memFiles
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() os.FileMode  { return 0444 }
+func (i memFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() interface{}   { return nil }
@@ -11,7 +11,8 @@ according to http://wiki.freepascal.org/Multiplatform_Programming_Guide#Configur
 import (
 	"os"
 	"path/filepath"
-	"strings"
+	"syscall"
+	"unsafe"
 )
 
 func setUserDir() {
@@ -35,8 +36,32 @@ func setWorkingDir() {
 	WORKING_DIR = wd
 }
 
-func splitGlobals() []string {
-	return strings.Split(GLOBAL_DIRS, ":")
+// terminalWidth returns the number of columns of the terminal that is attached
+// to stdout or 0 if stdout is no terminal
+func terminalWidth() int {
+	var ws struct{ Row, Col, Xpixel, Ypixel uint16 }
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdout.Fd(), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 {
+		return 0
+	}
+	return int(ws.Col)
+}
+
+// disableEcho disables the echo of the terminal with the given file descriptor
+// and returns a function to restore it. ok is false, if fd is no terminal.
+func disableEcho(fd uintptr) (restore func(), ok bool) {
+	var old syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TIOCGETA), uintptr(unsafe.Pointer(&old))); errno != 0 {
+		return nil, false
+	}
+	noEcho := old
+	noEcho.Lflag &^= syscall.ECHO
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TIOCSETA), uintptr(unsafe.Pointer(&noEcho))); errno != 0 {
+		return nil, false
+	}
+	return func() {
+		syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TIOCSETA), uintptr(unsafe.Pointer(&old)))
+	}, true
 }
 
 func init() {
@@ -1,6 +1,6 @@
 // +build linux
 
-// set USER_DIR, GLOBAL_DIRS and WORKING_DIR based on the XDG Base Directory Specification
+// set USER_DIR, GLOBAL_DIRS, WORKING_DIR and RUNTIME_DIR based on the XDG Base Directory Specification
 // see http://standards.freedesktop.org/basedir-spec/basedir-spec-latest.html
 
 /*
@@ -13,7 +13,8 @@ package config
 import (
 	"os"
 	"path/filepath"
-	"strings"
+	"syscall"
+	"unsafe"
 )
 
 func setUserDir() {
@@ -36,6 +37,10 @@ func setGlobalDir() {
 	GLOBAL_DIRS = xdg_config_dirs
 }
 
+func setRuntimeDir() {
+	RUNTIME_DIR = os.Getenv("XDG_RUNTIME_DIR")
+}
+
 func setWorkingDir() {
 	wd, err := os.Getwd()
 	if err != nil {
@@ -45,12 +50,37 @@ func setWorkingDir() {
 	WORKING_DIR = wd
 }
 
-func splitGlobals() []string {
-	return strings.Split(GLOBAL_DIRS, ":")
+// terminalWidth returns the number of columns of the terminal that is attached
+// to stdout or 0 if stdout is no terminal
+func terminalWidth() int {
+	var ws struct{ Row, Col, Xpixel, Ypixel uint16 }
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdout.Fd(), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 {
+		return 0
+	}
+	return int(ws.Col)
+}
+
+// disableEcho disables the echo of the terminal with the given file descriptor
+// and returns a function to restore it. ok is false, if fd is no terminal.
+func disableEcho(fd uintptr) (restore func(), ok bool) {
+	var old syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TCGETS), uintptr(unsafe.Pointer(&old))); errno != 0 {
+		return nil, false
+	}
+	noEcho := old
+	noEcho.Lflag &^= syscall.ECHO
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TCSETS), uintptr(unsafe.Pointer(&noEcho))); errno != 0 {
+		return nil, false
+	}
+	return func() {
+		syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TCSETS), uintptr(unsafe.Pointer(&old)))
+	}, true
 }
 
 func init() {
 	setUserDir()
 	setGlobalDir()
 	setWorkingDir()
+	setRuntimeDir()
 }
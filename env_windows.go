@@ -7,7 +7,6 @@ package config
 import (
 	"os"
 	"path/filepath"
-	"strings"
 )
 
 func setUserDir() {
@@ -35,8 +34,14 @@ func setWorkingDir() {
 	WORKING_DIR = filepath.ToSlash(wd)
 }
 
-func splitGlobals() []string {
-	return strings.Split(GLOBAL_DIRS, ";")
+// terminalWidth is not supported here and always returns 0
+func terminalWidth() int {
+	return 0
+}
+
+// disableEcho is not supported here and always returns false
+func disableEcho(fd uintptr) (restore func(), ok bool) {
+	return nil, false
 }
 
 func init() {
@@ -3,6 +3,7 @@ package config
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 var (
@@ -10,6 +11,7 @@ var (
 	ErrInvalidVersion   = errors.New("invalid version")
 	ErrInvalidShortflag = errors.New("invalid shortflag")
 	ErrCommandCommand   = errors.New("command of command is not supported")
+	ErrInvalidPosition  = errors.New("invalid position")
 
 	//ErrInvalidDefault = errors.New("invalid default")
 	// ErrInvalidValue   = errors.New("invalid value")
@@ -22,6 +24,23 @@ func (e EmptyValueError) Error() string {
 	return fmt.Sprintf("invalid value: empty string for %#v", string(e))
 }
 
+// EmptyValueSourceError wraps an EmptyValueError with the Source and the Location of
+// the empty value (e.g. the path of the config file or the name of the env variable).
+type EmptyValueSourceError struct {
+	Err      EmptyValueError
+	Source   Source
+	Location string
+}
+
+func (e EmptyValueSourceError) Error() string {
+	return fmt.Sprintf("%s (%s: %s)", e.Err.Error(), e.Source, e.Location)
+}
+
+// Unwrap returns the wrapped EmptyValueError
+func (e EmptyValueSourceError) Unwrap() error {
+	return e.Err
+}
+
 type InvalidNameError string
 
 func (e InvalidNameError) Error() string {
@@ -50,9 +69,14 @@ func (e InvalidDefault) Error() string {
 type MissingOptionError struct {
 	Version string
 	Option  string
+	// Message is the custom message of the option, see RequiredMessage
+	Message string
 }
 
 func (e MissingOptionError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("required option --%s not set: %s", e.Option, e.Message)
+	}
 	return fmt.Sprintf("required option --%s not set", e.Option)
 }
 
@@ -66,6 +90,17 @@ func (e InvalidConfigEnv) Error() string {
 	return fmt.Sprintf("env variable %s is not compatible with version %s: %s", e.EnvKey, e.Version, e.Err.Error())
 }
 
+// InvalidConfigRegistry is returned by MergeRegistry for invalid registry values
+type InvalidConfigRegistry struct {
+	Version     string
+	RegistryKey string
+	Err         error
+}
+
+func (e InvalidConfigRegistry) Error() string {
+	return fmt.Sprintf("registry value %s is not compatible with version %s: %s", e.RegistryKey, e.Version, e.Err.Error())
+}
+
 type InvalidConfigFlag struct {
 	Version string
 	Flag    string
@@ -95,6 +130,16 @@ func (e InvalidConfigFileError) Error() string {
 	return fmt.Sprintf("config file %s is not compatible with version %s: %s", e.ConfigFile, e.Version, e.Err.Error())
 }
 
+// ConfigFileSyntaxError is returned by CheckFile for config files with invalid syntax
+type ConfigFileSyntaxError struct {
+	ConfigFile string
+	Err        error
+}
+
+func (e ConfigFileSyntaxError) Error() string {
+	return fmt.Sprintf("syntax error in config file %s: %s", e.ConfigFile, e.Err.Error())
+}
+
 type InvalidValueError struct {
 	Option string
 	Value  interface{}
@@ -125,14 +170,146 @@ func (e UnknownOptionError) Error() string {
 	return fmt.Sprintf("option %s is unknown in version %s", e.Option, e.Version)
 }
 
+// ErrDoubleOption is returned for options that are defined twice or given twice
+// as commandline flags (see DuplicateKeyError for config files)
 type ErrDoubleOption string
 
 func (e ErrDoubleOption) Error() string {
 	return fmt.Sprintf("option %s is set twice", string(e))
 }
 
+// DuplicateKeyError is returned for a key that is set twice inside the same config file
+// (in contrast to ErrDoubleOption for options that are defined twice)
+type DuplicateKeyError struct {
+	Key       string
+	Line      int
+	FirstLine int
+}
+
+func (e DuplicateKeyError) Error() string {
+	return fmt.Sprintf("option %s is set twice in line %d (first in line %d)", e.Key, e.Line, e.FirstLine)
+}
+
+// ErrDoubleShortflag is returned for a shortflag that is already taken by an option of the
+// app or of one of its commands
 type ErrDoubleShortflag string
 
 func (e ErrDoubleShortflag) Error() string {
 	return fmt.Sprintf("shortflag %s is set twice", string(e))
 }
+
+type UnknownCommandError string
+
+func (e UnknownCommandError) Error() string {
+	return fmt.Sprintf("unknown command %#v", string(e))
+}
+
+type CommandError struct {
+	Command string
+	Err     error
+}
+
+func (e CommandError) Error() string {
+	return fmt.Sprintf("command %s: %s", e.Command, e.Err.Error())
+}
+
+type ErrDoublePosition int
+
+func (e ErrDoublePosition) Error() string {
+	return fmt.Sprintf("position %d is set twice", int(e))
+}
+
+type PositionalConflictError struct {
+	Option     string
+	Flag       interface{}
+	Positional interface{}
+}
+
+func (e PositionalConflictError) Error() string {
+	return fmt.Sprintf("option %s is set via flag to %#v and via positional argument to %#v", e.Option, e.Flag, e.Positional)
+}
+
+// OptionScopeError is returned, if an option is passed that is not known in the
+// current scope, but is an option of a command
+type OptionScopeError struct {
+	Version string
+	Option  string
+	Command string
+}
+
+func (e OptionScopeError) Error() string {
+	return fmt.Sprintf("option %s is unknown here, but belongs to the command %s: pass it after the command %s", e.Option, e.Command, e.Command)
+}
+
+type TransformError struct {
+	Option string
+	Value  interface{}
+	Err    error
+}
+
+func (e TransformError) Error() string {
+	return fmt.Sprintf("value %#v is invalid for option %s: %s", e.Value, e.Option, e.Err.Error())
+}
+
+type InvalidPrefixError string
+
+func (e InvalidPrefixError) Error() string {
+	return fmt.Sprintf("invalid prefix %#v for config files", string(e))
+}
+
+type ChecksumError struct {
+	Location string
+	Expected string
+	Got      string
+}
+
+func (e ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s: expected %s, got %s", e.Location, e.Expected, e.Got)
+}
+
+type InvalidPrecedenceError string
+
+func (e InvalidPrecedenceError) Error() string {
+	return fmt.Sprintf("invalid precedence %s: every source must be given exactly once", string(e))
+}
+
+type DefaultCycleError []string
+
+func (e DefaultCycleError) Error() string {
+	return fmt.Sprintf("cyclic defaults of options: %s", strings.Join([]string(e), " -> "))
+}
+
+type ReferenceCycleError []string
+
+func (e ReferenceCycleError) Error() string {
+	return fmt.Sprintf("cyclic references of options: %s", strings.Join([]string(e), " -> "))
+}
+
+type UndefinedReferenceError struct {
+	Option    string
+	Reference string
+}
+
+func (e UndefinedReferenceError) Error() string {
+	return fmt.Sprintf("option %s refers to option %s that is not set", e.Option, e.Reference)
+}
+
+type SchemaError struct {
+	Option  string
+	Path    string
+	Message string
+}
+
+func (e SchemaError) Error() string {
+	return fmt.Sprintf("value of option %s does not match the json schema at %s: %s", e.Option, e.Path, e.Message)
+}
+
+type CommandOutputError struct {
+	Option  string
+	Command []string
+	Err     error
+}
+
+func (e CommandOutputError) Error() string {
+	return fmt.Sprintf("can't get value of option %s from command %s: %s", e.Option, strings.Join(e.Command, " "), e.Err.Error())
+}
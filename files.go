@@ -1,41 +1,333 @@
 package config
 
 import (
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 var (
 	USER_DIR    string
-	GLOBAL_DIRS string // colon separated list to look for
+	GLOBAL_DIRS string // list of dirs to look for, separated by os.PathListSeparator
 	WORKING_DIR string
+	RUNTIME_DIR string // dir for ephemeral config of running services, empty if not supported
 	CONFIG_EXT  = ".conf"
 	ENV         []string
 	ARGS        []string
+	STDIN       io.Reader
+
+	// lines of config files starting with COMMENT_PREFIX are comments,
+	// lines starting with OPTION_PREFIX start an option (see ValidatePrefixes)
+	COMMENT_PREFIX = "#"
+	OPTION_PREFIX  = "$"
 )
 
+// FileSystem is the filesystem that config files are read from and written to
+// (see SetFileSystem and WriteConfigFileTo).
+// OSFileSystem is the implementation for the real filesystem.
+type FileSystem interface {
+	Open(name string) (io.ReadCloser, error)
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	Remove(name string) error
+	OpenFile(name string, flag int, perm os.FileMode) (WritableFile, error)
+}
+
+// WritableFile is a file opened by a FileSystem for writing
+type WritableFile interface {
+	io.StringWriter
+	io.Closer
+}
+
+// OSFileSystem is the FileSystem of the os package
+type OSFileSystem struct{}
+
+func (OSFileSystem) Open(name string) (io.ReadCloser, error)      { return os.Open(name) }
+func (OSFileSystem) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (OSFileSystem) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (OSFileSystem) ReadFile(name string) ([]byte, error)         { return ioutil.ReadFile(name) }
+func (OSFileSystem) Remove(name string) error                     { return os.Remove(name) }
+
+func (OSFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(name, data, perm)
+}
+
+func (OSFileSystem) OpenFile(name string, flag int, perm os.FileMode) (WritableFile, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
 func init() {
 	ENV = os.Environ()
 	ARGS = os.Args[1:]
+	STDIN = os.Stdin
+}
+
+// SetFileSystem sets the FileSystem that the config files of this config and its
+// commands are read from and written to, e.g. an in-memory filesystem for tests.
+// By default, the OSFileSystem is used. It is chainable.
+func (c *Config) SetFileSystem(fsys FileSystem) *Config {
+	c.fsys = fsys
+	return c
+}
+
+// fileSystem returns the FileSystem of the config files, see SetFileSystem
+func (c *Config) fileSystem() FileSystem {
+	if c.parent != nil {
+		return c.parent.fileSystem()
+	}
+	if c.fsys != nil {
+		return c.fsys
+	}
+	return OSFileSystem{}
+}
+
+// SetConfigExt sets the file extension of the config files of the app, overriding CONFIG_EXT
+// for this config and its commands. It is chainable.
+func (c *Config) SetConfigExt(ext string) *Config {
+	c.ext = ext
+	return c
+}
+
+// configExt returns the file extension of the config files
+func (c *Config) configExt() string {
+	if c.parent != nil {
+		return c.parent.configExt()
+	}
+	if c.ext != "" {
+		return c.ext
+	}
+	return CONFIG_EXT
+}
+
+// SetArgs sets the commandline args (without the program name) for this config and
+// its commands, overriding ARGS. The given slice is not modified, so that Load can be
+// called again. It is chainable.
+func (c *Config) SetArgs(args []string) *Config {
+	c.args = append([]string{}, args...)
+	return c
+}
+
+// arguments returns the commandline args, see SetArgs
+func (c *Config) arguments() []string {
+	if c.parent != nil {
+		return c.parent.arguments()
+	}
+	if c.args != nil {
+		return c.args
+	}
+	return ARGS
+}
+
+// SetEnv sets the env variables (in the form KEY=value) for this config and its
+// commands, overriding ENV. It is chainable.
+func (c *Config) SetEnv(env []string) *Config {
+	c.env = append([]string{}, env...)
+	return c
+}
+
+// environ returns the env variables, see SetEnv
+func (c *Config) environ() []string {
+	if c.parent != nil {
+		return c.parent.environ()
+	}
+	if c.env != nil {
+		return c.env
+	}
+	return ENV
+}
+
+// SetEnvironment sets the environment (e.g. "production") of the app for this config
+// and its commands. It is chainable.
+// If an environment is set, the config files are named [app].[environment][ext], e.g.
+// myapp.production.conf, if they exist. Otherwise the usual names are used.
+// If no environment is set, it is taken from the --env flag (unless the app has its
+// own env option) or from the env variable [APP]_ENV.
+func (c *Config) SetEnvironment(name string) *Config {
+	c.environment = name
+	return c
+}
+
+// environmentName returns the environment of the app, see SetEnvironment
+func (c *Config) environmentName() string {
+	if c.parent != nil {
+		return c.parent.environmentName()
+	}
+	if c.environment != "" {
+		return c.environment
+	}
+	if _, has := c.spec["env"]; !has {
+		args, _ := splitArgs(c.arguments())
+		for _, arg := range args {
+			if strings.HasPrefix(arg, "--env=") {
+				return strings.TrimPrefix(arg, "--env=")
+			}
+		}
+	}
+	prefix := strings.ToUpper(c.app) + "_ENV="
+	for _, pair := range c.environ() {
+		if strings.HasPrefix(pair, prefix) {
+			return strings.TrimSpace(strings.TrimPrefix(pair, prefix))
+		}
+	}
+	return ""
+}
+
+// configFile returns the path of the config file inside the given dir, preferring
+// the file for the environment (see SetEnvironment), if it exists
+func (c *Config) configFile(dir string) string {
+	if env := c.environmentName(); env != "" && !strings.ContainsAny(env, `/\`) {
+		file := filepath.Join(dir, c.appName()+"."+env+c.configExt())
+		if _, err := c.fileSystem().Stat(file); err == nil {
+			return file
+		}
+	}
+	return filepath.Join(dir, c.appName()+c.configExt())
 }
 
 // globalsFile returns the global config file path for the given dir
 func (c *Config) globalsFile(dir string) string {
-	return filepath.Join(dir, c.appName(), c.appName()+CONFIG_EXT)
+	return c.configFile(filepath.Join(dir, c.appName()))
 }
 
 // UserFile returns the user defined config file path
 func (c *Config) UserFile() string {
-	return filepath.Join(USER_DIR, c.appName(), c.appName()+CONFIG_EXT)
+	return c.configFile(filepath.Join(USER_DIR, c.appName()))
+}
+
+// RuntimeFile returns the config file inside the RUNTIME_DIR (on linux $XDG_RUNTIME_DIR),
+// e.g. for ephemeral config of a running service. If RUNTIME_DIR is not set, the empty
+// string is returned.
+func (c *Config) RuntimeFile() string {
+	if RUNTIME_DIR == "" {
+		return ""
+	}
+	return c.configFile(filepath.Join(RUNTIME_DIR, c.appName()))
 }
 
 // LocalFile returns the local config file (inside the .config subdir of the current working dir)
 func (c *Config) LocalFile() string {
-	//fmt.Println(WORKING_DIR, ".config", c.appName(), c.appName()+CONFIG_EXT)
-	return filepath.Join(WORKING_DIR, ".config", c.appName(), c.appName()+CONFIG_EXT)
+	//fmt.Println(WORKING_DIR, ".config", c.appName(), c.appName()+c.configExt())
+	return c.localFile(WORKING_DIR)
+}
+
+// localFile returns the local config file inside the .config subdir of the given dir
+func (c *Config) localFile(dir string) string {
+	return c.configFile(filepath.Join(dir, ".config", c.appName()))
+}
+
+// SearchLocalInParents makes LoadLocals look for the local config file in the
+// parent directories of the working dir, if there is none in the working dir.
+// The nearest local config file is loaded. SearchLocalInParents is chainable.
+func (c *Config) SearchLocalInParents() *Config {
+	c.searchParents = true
+	return c
+}
+
+// findLocalFile returns the local config file that should be loaded.
+// If searching in parent directories is enabled, it returns the first existing
+// local config file, starting from the working dir up to the filesystem root.
+// If none could be found, LocalFile() is returned.
+func (c *Config) findLocalFile() string {
+	root := c
+	if c.parent != nil {
+		root = c.parent
+	}
+	if !root.searchParents {
+		return c.LocalFile()
+	}
+	dir := WORKING_DIR
+	for {
+		file := c.localFile(dir)
+		if _, err := c.fileSystem().Stat(file); err == nil {
+			return file
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return c.LocalFile()
+		}
+		dir = parent
+	}
 }
 
 // GlobalFile returns the path for the global config file in the first global directory
+// If GLOBAL_DIRS is empty, the empty string is returned
 func (c *Config) FirstGlobalsFile() string {
-	return c.globalsFile(splitGlobals()[0])
+	dirs := splitGlobals()
+	if len(dirs) == 0 {
+		return ""
+	}
+	return c.globalsFile(dirs[0])
+}
+
+// splitGlobals returns the directories of GLOBAL_DIRS which is a list separated by
+// the list separator of the operating system
+func splitGlobals() []string {
+	return filepath.SplitList(GLOBAL_DIRS)
+}
+
+// sourceFiles returns the config files of the given source (SourceGlobals, SourceUser,
+// SourceRuntime or SourceLocals) in the order Load tries them. Load merges the first
+// of them that exists.
+func (c *Config) sourceFiles(src Source) []string {
+	switch src {
+	case SourceGlobals:
+		var files []string
+		for _, dir := range splitGlobals() {
+			files = append(files, c.globalsFile(dir))
+		}
+		return files
+	case SourceUser:
+		return []string{c.UserFile()}
+	case SourceRuntime:
+		if path := c.RuntimeFile(); path != "" {
+			return []string{path}
+		}
+	case SourceLocals:
+		return []string{c.findLocalFile()}
+	}
+	return nil
+}
+
+// SourceFile returns the config file of the given source that is merged by Load.
+// If none of the files of the source exists, the first one is returned
+// (or the empty string, if the source has no files).
+func (c *Config) SourceFile(src Source) string {
+	files := c.sourceFiles(src)
+	for _, path := range files {
+		if c.isReadable(path) {
+			return path
+		}
+	}
+	if len(files) == 0 {
+		return ""
+	}
+	return files[0]
+}
+
+// FileStatus reports for each layer ("global", "user", "runtime" and "local") if there is
+// a config file that is loaded by Load, i.e. that exists and is readable
+func (c *Config) FileStatus() map[string]bool {
+	return map[string]bool{
+		"global":  c.isReadable(c.SourceFile(SourceGlobals)),
+		"user":    c.isReadable(c.SourceFile(SourceUser)),
+		"runtime": c.isReadable(c.SourceFile(SourceRuntime)),
+		"local":   c.isReadable(c.SourceFile(SourceLocals)),
+	}
+}
+
+// isReadable returns true, if the file exists and can be opened for reading
+func (c *Config) isReadable(path string) bool {
+	if path == "" {
+		return false
+	}
+	file, err := c.fileSystem().Open(path)
+	if err != nil {
+		return false
+	}
+	file.Close()
+	return true
 }
@@ -69,6 +69,10 @@ func (b *DateTimeGetter) Get() time.Time {
 	return b.cfg.GetTime(b.opt.Name)
 }
 
+func (b *DateTimeGetter) GetOr(fallback time.Time) time.Time {
+	return b.cfg.GetTimeOr(b.opt.Name, fallback)
+}
+
 type JSONGetter struct {
 	opt *Option
 	cfg *Config
@@ -81,3 +85,116 @@ func (b *JSONGetter) IsSet() bool {
 func (b *JSONGetter) Get(val interface{}) error {
 	return b.cfg.GetJSON(b.opt.Name, val)
 }
+
+type ListGetter struct {
+	opt *Option
+	cfg *Config
+}
+
+func (b *ListGetter) IsSet() bool {
+	return b.cfg.IsSet(b.opt.Name)
+}
+
+func (b *ListGetter) Get() []string {
+	return b.cfg.GetList(b.opt.Name)
+}
+
+type BinaryGetter struct {
+	opt *Option
+	cfg *Config
+}
+
+func (b *BinaryGetter) IsSet() bool {
+	return b.cfg.IsSet(b.opt.Name)
+}
+
+func (b *BinaryGetter) Get() []byte {
+	return b.cfg.GetBinary(b.opt.Name)
+}
+
+// registeredOption returns the registered option with the given name, if it has one of the given types
+func (c *Config) registeredOption(name string, types ...string) (*Option, error) {
+	opt, has := c.spec[name]
+	if !has {
+		return nil, UnknownOptionError{c.version, name}
+	}
+	for _, typ := range types {
+		if opt.Type == typ {
+			return opt, nil
+		}
+	}
+	return nil, InvalidTypeError{name, opt.Type}
+}
+
+// BoolOption returns a getter for the registered bool option with the given name,
+// e.g. for specs that have been unmarshalled from JSON
+func (c *Config) BoolOption(name string) (*BoolGetter, error) {
+	opt, err := c.registeredOption(name, "bool")
+	if err != nil {
+		return nil, err
+	}
+	return &BoolGetter{opt: opt, cfg: c}, nil
+}
+
+// Int32Option returns a getter for the registered int32 option with the given name
+func (c *Config) Int32Option(name string) (*Int32Getter, error) {
+	opt, err := c.registeredOption(name, "int32")
+	if err != nil {
+		return nil, err
+	}
+	return &Int32Getter{opt: opt, cfg: c}, nil
+}
+
+// Float32Option returns a getter for the registered float32 option with the given name
+func (c *Config) Float32Option(name string) (*Float32Getter, error) {
+	opt, err := c.registeredOption(name, "float32")
+	if err != nil {
+		return nil, err
+	}
+	return &Float32Getter{opt: opt, cfg: c}, nil
+}
+
+// StringOption returns a getter for the registered string option with the given name
+func (c *Config) StringOption(name string) (*StringGetter, error) {
+	opt, err := c.registeredOption(name, "string")
+	if err != nil {
+		return nil, err
+	}
+	return &StringGetter{opt: opt, cfg: c}, nil
+}
+
+// DateTimeOption returns a getter for the registered datetime, date or time option with the given name
+func (c *Config) DateTimeOption(name string) (*DateTimeGetter, error) {
+	opt, err := c.registeredOption(name, "datetime", "date", "time")
+	if err != nil {
+		return nil, err
+	}
+	return &DateTimeGetter{opt: opt, cfg: c}, nil
+}
+
+// JSONOption returns a getter for the registered json option with the given name
+func (c *Config) JSONOption(name string) (*JSONGetter, error) {
+	opt, err := c.registeredOption(name, "json")
+	if err != nil {
+		return nil, err
+	}
+	return &JSONGetter{opt: opt, cfg: c}, nil
+}
+
+// ListOption returns a getter for the registered list option with the given name
+func (c *Config) ListOption(name string) (*ListGetter, error) {
+	opt, err := c.registeredOption(name, "list")
+	if err != nil {
+		return nil, err
+	}
+	return &ListGetter{opt: opt, cfg: c}, nil
+}
+
+// BinaryOption returns a getter for the registered binary option with the given name
+func (c *Config) BinaryOption(name string) (*BinaryGetter, error) {
+	opt, err := c.registeredOption(name, "binary")
+	if err != nil {
+		return nil, err
+	}
+	return &BinaryGetter{opt: opt, cfg: c}, nil
+}
@@ -1,3 +1,5 @@
 module github.com/metakeule/config
 
+go 1.16
+
 require github.com/metakeule/fmtdate v1.1.1
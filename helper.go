@@ -1,14 +1,20 @@
 package config
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
@@ -17,6 +23,12 @@ const (
 	DateTimeFormat = "2006-01-02 15:04:05"
 )
 
+// HelpWidth is the maximal width of the lines of help texts, both inside the
+// terminal help and inside the comments of written config files.
+// If HelpWidth is 0, the width of the terminal is used for the terminal help
+// (if stdout is a terminal) and 80 otherwise.
+var HelpWidth = 0
+
 var (
 	NameRegExp      = regexp.MustCompile("^[a-z][a-z0-9]+$")
 	VersionRegexp   = regexp.MustCompile("^[a-z0-9-.]+$")
@@ -45,6 +57,26 @@ func ValidateName(name string) error {
 	return nil
 }
 
+// ValidatePrefixes checks if COMMENT_PREFIX and OPTION_PREFIX are valid.
+// Both must be single, different characters that are not likely to start
+// a line of a value, i.e. no letters, digits, whitespace or quotes and
+// none of the characters -+.,:;=_/\(){}[]<>
+func ValidatePrefixes() error {
+	for _, prefix := range []string{COMMENT_PREFIX, OPTION_PREFIX} {
+		if utf8.RuneCountInString(prefix) != 1 {
+			return InvalidPrefixError(prefix)
+		}
+		r, _ := utf8.DecodeRuneInString(prefix)
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) || strings.ContainsRune("\"'`-+.,:;=_/\\(){}[]<>", r) {
+			return InvalidPrefixError(prefix)
+		}
+	}
+	if COMMENT_PREFIX == OPTION_PREFIX {
+		return InvalidPrefixError(OPTION_PREFIX)
+	}
+	return nil
+}
+
 func ValidateVersion(version string) error {
 	if !VersionRegexp.MatchString(version) {
 		return ErrInvalidVersion
@@ -57,7 +89,7 @@ func ValidateVersion(version string) error {
 // ErrInvalidType is returned
 func ValidateType(option, typ string) error {
 	switch typ {
-	case "bool", "int32", "float32", "string", "datetime", "date", "time", "json":
+	case "bool", "int32", "float32", "string", "datetime", "date", "time", "json", "list", "binary":
 		return nil
 	default:
 		return InvalidTypeError{option, typ}
@@ -74,9 +106,11 @@ func stringToValue(typ string, in string) (out interface{}, err error) {
 	case "bool":
 		return strconv.ParseBool(in)
 	case "int32":
-		i, e := strconv.ParseInt(in, 10, 32)
-		return int32(i), e
+		return parseInt32(in)
 	case "float32":
+		if in, err = stripDigitSeparators(in); err != nil {
+			return nil, err
+		}
 		fl, e := strconv.ParseFloat(in, 32)
 		return float32(fl), e
 	case "datetime":
@@ -94,12 +128,297 @@ func stringToValue(typ string, in string) (out interface{}, err error) {
 			return nil, err
 		}
 		return in, nil
+	case "list":
+		return stringToList(in, ","), nil
+	case "binary":
+		return base64.StdEncoding.DecodeString(in)
 	default:
 		return nil, errors.New("unknown type " + typ)
 	}
 
 }
 
+// relaxedJSON converts relaxed JSON (unquoted keys, single quoted strings,
+// trailing commas and comments) to compact strict JSON
+func relaxedJSON(in string) (string, error) {
+	var bf bytes.Buffer
+	for i := 0; i < len(in); i++ {
+		ch := in[i]
+		switch {
+		case ch == '"':
+			end := i + 1
+			for ; end < len(in) && in[end] != '"'; end++ {
+				if in[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(in) {
+				return "", errors.New("unterminated string")
+			}
+			bf.WriteString(in[i : end+1])
+			i = end
+		case ch == '\'':
+			// escapes are kept, except for \' which is no valid escape in JSON
+			bf.WriteByte('"')
+			end := i + 1
+			for ; end < len(in) && in[end] != '\''; end++ {
+				switch {
+				case in[end] == '\\' && end+1 < len(in) && in[end+1] == '\'':
+					end++
+					bf.WriteByte('\'')
+				case in[end] == '\\' && end+1 < len(in):
+					bf.WriteString(in[end : end+2])
+					end++
+				case in[end] == '"':
+					bf.WriteString(`\"`)
+				default:
+					bf.WriteByte(in[end])
+				}
+			}
+			if end >= len(in) {
+				return "", errors.New("unterminated string")
+			}
+			bf.WriteByte('"')
+			i = end
+		case strings.HasPrefix(in[i:], "//"):
+			for i < len(in) && in[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(in[i:], "/*"):
+			end := strings.Index(in[i+2:], "*/")
+			if end == -1 {
+				return "", errors.New("unterminated comment")
+			}
+			i += end + 3
+		case ch == '}' || ch == ']':
+			// remove trailing commas
+			trimmed := bytes.TrimRight(bf.Bytes(), " \t\r\n")
+			if len(trimmed) > 0 && trimmed[len(trimmed)-1] == ',' {
+				bf.Truncate(len(trimmed) - 1)
+			}
+			bf.WriteByte(ch)
+		case ch == '-' || ch == '.' || (ch >= '0' && ch <= '9'):
+			// numbers may contain letters (exponents) which must not be quoted
+			end := i
+			for end < len(in) && strings.ContainsRune("0123456789+-.eE", rune(in[end])) {
+				end++
+			}
+			bf.WriteString(in[i:end])
+			i = end - 1
+		case isIdentStart(in[i:]):
+			end := i
+			for end < len(in) {
+				r, size := utf8.DecodeRuneInString(in[end:])
+				if r != '_' && r != '$' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				end += size
+			}
+			switch word := in[i:end]; word {
+			case "true", "false", "null":
+				bf.WriteString(word)
+			default:
+				bf.WriteString(`"` + word + `"`)
+			}
+			i = end - 1
+		default:
+			bf.WriteByte(ch)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := json.Compact(&out, bf.Bytes()); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// isIdentStart checks if the given string starts with a character that may start
+// an unquoted key in relaxed JSON
+func isIdentStart(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return r == '_' || r == '$' || unicode.IsLetter(r)
+}
+
+// parseInt32 parses decimal, hexadecimal (0x1F), octal (0o17) and binary (0b1010)
+// integers as well as integral numbers in exponent notation (1e6). Decimal numbers
+// with leading zeros are decimal (not octal). Underscores may separate digits.
+func parseInt32(in string) (int32, error) {
+	digits := strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(in, "-"), "+"))
+	switch {
+	case strings.HasPrefix(digits, "0x"), strings.HasPrefix(digits, "0o"), strings.HasPrefix(digits, "0b"):
+		i, err := strconv.ParseInt(in, 0, 32)
+		return int32(i), err
+	case strings.Contains(digits, "e"):
+		dec, err := stripDigitSeparators(in)
+		if err != nil {
+			return 0, err
+		}
+		fl, err := strconv.ParseFloat(dec, 64)
+		if err != nil {
+			return 0, err
+		}
+		if fl != math.Trunc(fl) || fl < math.MinInt32 || fl > math.MaxInt32 {
+			return 0, fmt.Errorf("%#v is not an int32", in)
+		}
+		return int32(fl), nil
+	default:
+		dec, err := stripDigitSeparators(in)
+		if err != nil {
+			return 0, err
+		}
+		i, err := strconv.ParseInt(dec, 10, 32)
+		return int32(i), err
+	}
+}
+
+// stripDigitSeparators removes the underscores that separate digits in numbers
+// (e.g. 1_000_000) like in Go literals. Underscores that are not placed between
+// two digits are invalid.
+func stripDigitSeparators(in string) (string, error) {
+	if !strings.Contains(in, "_") {
+		return in, nil
+	}
+	isDigit := func(b byte) bool { return b >= '0' && b <= '9' }
+	for i := 0; i < len(in); i++ {
+		if in[i] == '_' && (i == 0 || i == len(in)-1 || !isDigit(in[i-1]) || !isDigit(in[i+1])) {
+			return "", fmt.Errorf("invalid placement of _ in %#v", in)
+		}
+	}
+	return strings.Replace(in, "_", "", -1), nil
+}
+
+// valueToString converts the value of the given option to a string that is parsed
+// back to the same value, e.g. from env variables
+func valueToString(opt *Option, v interface{}) (string, error) {
+	switch ty := v.(type) {
+	case string:
+		return ty, nil
+	case time.Time:
+		switch opt.Type {
+		case "date":
+			return ty.Format(DateFormat), nil
+		case "time":
+			return ty.Format(TimeFormat), nil
+		default:
+			return ty.Format(DateTimeFormat), nil
+		}
+	case []byte:
+		return base64.StdEncoding.EncodeToString(ty), nil
+	case []string:
+		return strings.Join(ty, opt.listSeparator()), nil
+	case bool, int32, float32:
+		return fmt.Sprintf("%v", ty), nil
+	default:
+		bt, err := json.Marshal(ty)
+		return string(bt), err
+	}
+}
+
+// shellQuote quotes s in single quotes for the shell. Single quotes inside s
+// are replaced by quote, backslash, quote, quote
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// shellQuoteIfNeeded returns s unchanged, if it consists of characters that have no
+// special meaning to the shell, otherwise it is quoted (see shellQuote). Values with
+// linefeeds or tabs are written ANSI-C quoted ($'...'), so that they fit in a single line.
+func shellQuoteIfNeeded(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("_-+.,:/@=%", r))
+	}) == -1 {
+		return s
+	}
+	if !strings.ContainsAny(s, "\n\r\t") {
+		return shellQuote(s)
+	}
+	r := strings.NewReplacer(`\`, `\\`, "'", `\'`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return "$'" + r.Replace(s) + "'"
+}
+
+// expandPath expands a leading ~ to the home dir of the user and $VAR or ${VAR}
+// via lookup (see lookupEnv)
+func expandPath(path string, lookup func(string) string) (string, error) {
+	if path == "~" || strings.HasPrefix(path, "~/") || strings.HasPrefix(path, "~"+string(filepath.Separator)) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(home, path[1:])
+	}
+	return os.Expand(path, lookup), nil
+}
+
+// lookupEnv returns the value of the env variable with the given name inside env
+// (unknown variables expand to "")
+func lookupEnv(env []string, name string) string {
+	prefix := name + "="
+	for _, pair := range env {
+		if strings.HasPrefix(pair, prefix) {
+			return strings.TrimPrefix(pair, prefix)
+		}
+	}
+	return ""
+}
+
+// stringToList splits the given string at the separator, trimming whitespace around the values.
+// An empty string results in an empty list.
+func stringToList(in string, sep string) []string {
+	if strings.TrimSpace(in) == "" {
+		return []string{}
+	}
+	values := strings.Split(in, sep)
+	for i, v := range values {
+		values[i] = strings.TrimSpace(v)
+	}
+	return values
+}
+
+// numberRegExp matches decimal numbers (with optional fraction and exponent) and
+// hexadecimal, octal and binary integers, but not NaN or infinity
+var numberRegExp = regexp.MustCompile(`^[-+]?((\d[\d_]*(\.\d*)?|\.\d+)([eE][-+]?\d+)?|0[xXoObB][0-9a-fA-F_]+)$`)
+
+// isNumber checks if the given string is an integer or a float
+func isNumber(s string) bool {
+	return numberRegExp.MatchString(s)
+}
+
+// escapeValue escapes the lines of a value that continue in the following lines of a
+// config file, so that they are not mistaken for comments or options:
+// every line but the first that starts with COMMENT_PREFIX or OPTION_PREFIX, optionally
+// preceded by backslashes, is prefixed with a backslash. Other lines are kept as they are.
+func escapeValue(val string) string {
+	lines := strings.Split(val, "\n")
+	for i := 1; i < len(lines); i++ {
+		if startsWithPrefix(strings.TrimLeft(lines[i], "\\")) {
+			lines[i] = "\\" + lines[i]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// unescapeLine reverts the escaping of escapeValue for a single line: a leading
+// backslash is only removed, if it is followed by (backslashes and) COMMENT_PREFIX
+// or OPTION_PREFIX
+func unescapeLine(line string) string {
+	if strings.HasPrefix(line, "\\") && startsWithPrefix(strings.TrimLeft(line, "\\")) {
+		return line[1:]
+	}
+	return line
+}
+
+// startsWithPrefix checks if the line starts with COMMENT_PREFIX or OPTION_PREFIX
+func startsWithPrefix(line string) bool {
+	return strings.HasPrefix(line, COMMENT_PREFIX) || strings.HasPrefix(line, OPTION_PREFIX)
+}
+
+// envPrefix returns the prefix of the env variables of the given app (or command,
+// [app]_[command]), see MergeEnv
+func envPrefix(app string) string {
+	return strings.ToUpper(app) + "_CONFIG_"
+}
+
 func keyToArg(key string) string {
 	return "--" + key
 }
@@ -114,3 +433,46 @@ func err2Stderr(err error) {
 		os.Exit(1)
 	}
 }
+
+// fileHelpWidth returns the line width for help texts inside config files
+func fileHelpWidth() int {
+	if HelpWidth > 0 {
+		return HelpWidth
+	}
+	return 80
+}
+
+// terminalHelpWidth returns the line width for help texts printed to the terminal
+func terminalHelpWidth() int {
+	if HelpWidth > 0 {
+		return HelpWidth
+	}
+	if w := terminalWidth(); w > 0 {
+		return w
+	}
+	return 80
+}
+
+// wrap splits the given text into lines of at most width runes, breaking at whitespace.
+// Explicit newlines inside the text are kept as paragraph breaks.
+// Words that are longer than width get a line of their own.
+func wrap(text string, width int) (lines []string) {
+	for _, paragraph := range strings.Split(strings.TrimSpace(text), "\n") {
+		words := strings.Fields(paragraph)
+		if len(words) == 0 {
+			lines = append(lines, "")
+			continue
+		}
+		line := words[0]
+		for _, word := range words[1:] {
+			if len([]rune(line))+1+len([]rune(word)) > width {
+				lines = append(lines, line)
+				line = word
+				continue
+			}
+			line += " " + word
+		}
+		lines = append(lines, line)
+	}
+	return
+}
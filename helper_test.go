@@ -2,6 +2,8 @@ package config
 
 import (
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -41,3 +43,153 @@ func ExampleConfig() {
 	fmt.Printf("verbose: %v", verbose.Get())
 	// Output: verbose: true
 }
+
+func TestWrap(t *testing.T) {
+	tests := []struct {
+		text  string
+		width int
+		lines []string
+	}{
+		{"a short text", 20, []string{"a short text"}},
+		{"a text that is longer", 10, []string{"a text", "that is", "longer"}},
+		{"first paragraph\nsecond", 40, []string{"first paragraph", "second"}},
+		{"  spaces   are  collapsed  ", 40, []string{"spaces are collapsed"}},
+		{"averyveryverylongword x", 5, []string{"averyveryverylongword", "x"}},
+	}
+
+	for _, test := range tests {
+		got := strings.Join(wrap(test.text, test.width), "|")
+		if want := strings.Join(test.lines, "|"); got != want {
+			t.Errorf("wrap(%#v, %v) = %#v; want %#v", test.text, test.width, got, want)
+		}
+	}
+}
+
+func TestRelaxedJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{`{a:1,}`, `{"a":1}`},
+		{`{"a": [1, 2, 3,], b: 'it\'s "quoted"'}`, `{"a":[1,2,3],"b":"it's \"quoted\""}`},
+		{"{\n  // a comment\n  a: true, /* another */ b: null\n}", `{"a":true,"b":null}`},
+		{`[-1.5e3, 'x',]`, `[-1.5e3,"x"]`},
+		{`{"a,}": "b,]"}`, `{"a,}":"b,]"}`},
+		{`{größe: 'groß', ñ1: 1}`, `{"größe":"groß","ñ1":1}`},
+		{`{a: 'line\nbreak \u00e4 \\'}`, `{"a":"line\nbreak \u00e4 \\"}`},
+	}
+
+	for _, test := range tests {
+		got, err := relaxedJSON(test.in)
+		if err != nil {
+			t.Errorf("relaxedJSON(%#v) returned error: %s", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("relaxedJSON(%#v) = %#v; want %#v", test.in, got, test.want)
+		}
+	}
+
+	for _, in := range []string{`{a:}`, `{'a}`, `{a:1 /* }`} {
+		if _, err := relaxedJSON(in); err == nil {
+			t.Errorf("relaxedJSON(%#v) = nil error; want error", in)
+		}
+	}
+}
+
+func TestStringToValueDigitSeparators(t *testing.T) {
+	tests := []struct {
+		typ  string
+		in   string
+		want interface{}
+	}{
+		{"int32", "1_000_000", int32(1000000)},
+		{"int32", "-1_000", int32(-1000)},
+		{"float32", "1_000.5", float32(1000.5)},
+		{"float32", "0.000_1", float32(0.0001)},
+	}
+
+	for _, test := range tests {
+		got, err := stringToValue(test.typ, test.in)
+		if err != nil {
+			t.Errorf("stringToValue(%#v, %#v) returned error: %s", test.typ, test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("stringToValue(%#v, %#v) = %#v; want %#v", test.typ, test.in, got, test.want)
+		}
+	}
+
+	for _, in := range []string{"_1000", "1000_", "1__000", "1_.5", "-_1"} {
+		if _, err := stringToValue("float32", in); err == nil {
+			t.Errorf("stringToValue(\"float32\", %#v) = nil error; want error", in)
+		}
+	}
+}
+
+func TestParseInt32(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int32
+	}{
+		{"0x1F", 31},
+		{"0X1f", 31},
+		{"-0x1F", -31},
+		{"0b1010", 10},
+		{"0o17", 15},
+		{"0x_FF_FF", 65535},
+		{"1e6", 1000000},
+		{"1.5e1", 15},
+		{"010", 10},
+		{"1_000", 1000},
+	}
+
+	for _, test := range tests {
+		got, err := parseInt32(test.in)
+		if err != nil {
+			t.Errorf("parseInt32(%#v) returned error: %s", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseInt32(%#v) = %v; want %v", test.in, got, test.want)
+		}
+	}
+
+	for _, in := range []string{"0x", "0xG", "0b102", "1.5e0", "1e10", "1e", "--1", "0x1F.5"} {
+		if _, err := parseInt32(in); err == nil {
+			t.Errorf("parseInt32(%#v) = nil error; want error", in)
+		}
+	}
+}
+
+func TestIsNumber(t *testing.T) {
+	for _, s := range []string{"5", "-5", "+5", "-1.5", "-.5", "1e6", "-1.5E-3", "1_000", "-0x1F", "0b101"} {
+		if !isNumber(s) {
+			t.Errorf("isNumber(%#v) = false; want true", s)
+		}
+	}
+	for _, s := range []string{"", "-", "-inf", "inf", "NaN", "-v", "--5", "1.2.3", "-e5"} {
+		if isNumber(s) {
+			t.Errorf("isNumber(%#v) = true; want false", s)
+		}
+	}
+}
+
+func TestStringToList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"a, b ,c", []string{"a", "b", "c"}},
+		{"a", []string{"a"}},
+		{"a,,b", []string{"a", "", "b"}},
+		{"", []string{}},
+		{"  ", []string{}},
+	}
+
+	for _, test := range tests {
+		if got := stringToList(test.in, ","); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("stringToList(%#v) = %#v; want %#v", test.in, got, test.want)
+		}
+	}
+}
@@ -1,83 +1,203 @@
 package config
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 )
 
+// Source is a stage of Load that merges values from a source
+type Source string
+
+const (
+	SourceGlobals Source = "globals"
+	SourceUser    Source = "user"
+	SourceRuntime Source = "runtime"
+	SourceLocals  Source = "locals"
+	SourceEnv     Source = "env"
+
+	// the following sources have a fixed position and can't be reordered
+	SourceDefaults Source = "defaults"
+	SourceArgs     Source = "args"
+	// any other source, e.g. --config-file or Set
+	SourceOther Source = "other"
+)
+
+// DefaultPrecedence is the order in which Load merges the sources, if no other
+// order has been set via SetPrecedence. Later sources overwrite earlier ones.
+var DefaultPrecedence = []Source{SourceGlobals, SourceUser, SourceRuntime, SourceLocals, SourceEnv}
+
+// SetPrecedence sets the order in which Load merges the sources. Later sources
+// overwrite earlier ones. The defaults are always loaded first and the args
+// always last. The given sources must contain every Source of DefaultPrecedence exactly once.
+// SourceRuntime may be omitted, then it is merged directly after SourceUser.
+// The order applies to the options of the active command as well.
+func (c *Config) SetPrecedence(sources []Source) error {
+	seen := map[Source]bool{}
+	for _, src := range sources {
+		if src == SourceRuntime {
+			seen[src] = true
+		}
+	}
+	if !seen[SourceRuntime] {
+		var withRuntime []Source
+		for _, src := range sources {
+			withRuntime = append(withRuntime, src)
+			if src == SourceUser {
+				withRuntime = append(withRuntime, SourceRuntime)
+			}
+		}
+		sources = withRuntime
+	}
+	if len(sources) != len(DefaultPrecedence) {
+		return InvalidPrecedenceError(fmt.Sprintf("%v", sources))
+	}
+	seen = map[Source]bool{}
+	for _, src := range sources {
+		switch src {
+		case SourceGlobals, SourceUser, SourceRuntime, SourceLocals, SourceEnv:
+		default:
+			return InvalidPrecedenceError(fmt.Sprintf("%v", sources))
+		}
+		if seen[src] {
+			return InvalidPrecedenceError(fmt.Sprintf("%v", sources))
+		}
+		seen[src] = true
+	}
+	c.precedence = append([]Source{}, sources...)
+	return nil
+}
+
+// loadSources merges the sources in the order of precedence. The env variables of
+// the given command (if not nil) are merged together with those of the config.
+func (c *Config) loadSources(sub *Config) error {
+	precedence := c.precedence
+	if precedence == nil {
+		precedence = DefaultPrecedence
+	}
+	for _, src := range precedence {
+		var err error
+		switch src {
+		case SourceGlobals:
+			err = c.LoadGlobals()
+		case SourceUser:
+			err = c.LoadUser()
+		case SourceRuntime:
+			err = c.LoadRuntime()
+		case SourceLocals:
+			err = c.LoadLocals()
+		case SourceEnv:
+			err = c.MergeEnv()
+			if err == nil && sub != nil {
+				err = sub.MergeEnv()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *Config) Load(withArgs bool) error {
 	// clear old values
 	c.Reset()
 
-	// fmt.Printf("ARGS: %#v\n", ARGS)
+	// with --config-validate, invalid values of all sources are collected and
+	// reported instead of failing on the first one
+	c.validating = withArgs && c.validateFlagGiven()
+
+	// the command given via args, if any
+	var sub *Config
+	if withArgs {
+		if all := c.arguments(); len(all) > 0 {
+			sub, _ = c.lookupCommand(all[0])
+		}
+	}
 
 	// first load defaults
 	c.LoadDefaults()
-
-	// then overwrite with globals, return any error
-	if err := c.LoadGlobals(); err != nil {
-		return err
+	if sub != nil {
+		sub.Reset()
+		sub.LoadDefaults()
 	}
 
-	// then overwrite with user, return any error
-	if err := c.LoadUser(); err != nil {
+	// then overwrite with the default config file from the fs, return any error
+	if err := c.LoadDefaultsFS(); err != nil {
 		return err
 	}
 
-	// then overwrite with locals, return any error
-	if err := c.LoadLocals(); err != nil {
+	// then overwrite with globals, user, runtime, locals and env in the order of
+	// precedence, return any error
+	if err := c.loadSources(sub); err != nil {
 		return err
 	}
 
-	// then overwrite with env, return any error
-	if err := c.MergeEnv(); err != nil {
-		return err
+	if withArgs {
+		// then overwrite with the file given via --config-file, return any error
+		if err := c.loadConfigFileArg(); err != nil {
+			return err
+		}
 	}
 
 	if withArgs {
 
-		if len(ARGS) > 0 {
-			// fmt.Println("we are in subcommand " + ARGS[0])
-			if sub, has := c.commands[strings.ToLower(ARGS[0])]; has {
-				// fmt.Println("we are in subcommand " + ARGS[0])
+		if all := c.arguments(); len(all) > 0 {
+			// fmt.Println("we are in subcommand " + all[0])
+			if sub, has := c.lookupCommand(all[0]); has {
 				c.activeCommand = sub
-				if len(ARGS) == 1 {
-					ARGS = []string{}
-				} else {
-					ARGS = ARGS[1:]
-				}
 
-				sub.LoadDefaults()
+				// slice a local copy, so that Load can be called again
+				args, rest := splitArgs(all[1:])
+				c.consumedArgs = append([]string{sub.commandName()}, args...)
+				c.remainingArgs = rest
+				args = expandShortflags(args, sub, c)
 
-				// then overwrite with env, return any error
-				if err := sub.MergeEnv(); err != nil {
-					return err
-				}
-
-				merged1, err1 := c.mergeArgs(true, ARGS, sub.skippedOptions, sub.relaxedOptions)
+				merged1, err1 := c.mergeArgs(true, args, sub.skippedOptions, sub.relaxedOptions)
 				if err1 != nil {
 					return err1
 				}
 
+				// then overwrite inherited options with the values of the app
+				if err := c.inheritValues(sub); err != nil {
+					return err
+				}
+
 				emptyO := map[string]bool{}
 
 				// then overwrite with args
-				merged2, err2 := sub.mergeArgs(true, ARGS, emptyO, emptyO)
+				merged2, err2 := sub.mergeArgs(true, args, emptyO, emptyO)
 				if err2 != nil {
 					return err2
 				}
 
 				// fmt.Printf("merged1: %#v\nmerged2: %#v\n", merged1, merged2)
 
-				for _, arg := range ARGS {
+				for _, arg := range args {
 					key := arg
 					if idx := strings.Index(arg, "="); idx != -1 {
 						key = arg[:idx]
 					}
 
-					if !merged1[key] && !merged2[key] {
+					// positional args are tracked with their full value
+					if !merged1[key] && !merged2[key] && !merged1[arg] && !merged2[arg] {
+						if err := c.optionScopeError(arg, sub); err != nil {
+							return err
+						}
 						return UnknownOptionError{c.version, arg}
 					}
 				}
@@ -93,34 +213,325 @@ func (c *Config) Load(withArgs bool) error {
 		// then overwrite with args
 		return c.MergeArgs()
 	}
+
+	// otherwise resolved by mergeArgs
+	if err := c.resolveFromCommands(); err != nil {
+		return err
+	}
+	if err := c.resolveDefaultsFrom(); err != nil {
+		return err
+	}
+	return c.resolveReferences()
+}
+
+// validateFlagGiven reports, if the --config-validate flag is given inside the args
+// (see SetArgs) and has not been disabled (see SetIntrospectionFlags)
+func (c *Config) validateFlagGiven() bool {
+	if c.isFlagDisabled("config-validate") {
+		return false
+	}
+	args := c.arguments()
+	if len(args) > 0 {
+		if _, has := c.lookupCommand(args[0]); has {
+			args = args[1:]
+		}
+	}
+	args, _ = splitArgs(args)
+	for _, arg := range args {
+		if idx := strings.Index(arg, "="); idx != -1 {
+			arg = arg[:idx]
+		}
+		if strings.HasPrefix(arg, "-") && argToKey(arg) == "config-validate" {
+			return true
+		}
+	}
+	return false
+}
+
+// loadConfigFileArg merges the config file that is given via --config-file=PATH
+// or the JSON config given via --config-json=PATH (see MergeJSON) inside the args
+// (see SetArgs). If PATH is -, the config is read from STDIN.
+func (c *Config) loadConfigFileArg() error {
+	args := c.arguments()
+	if len(args) > 0 {
+		if _, has := c.lookupCommand(args[0]); has {
+			args = args[1:]
+		}
+	}
+	args, _ = splitArgs(args)
+
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--config-json=") {
+			if err := c.loadJSONArg(strings.TrimPrefix(arg, "--config-json=")); err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasPrefix(arg, "--config-file=") {
+			continue
+		}
+		path := strings.TrimPrefix(arg, "--config-file=")
+		if path == "-" {
+			if err := c.Merge(STDIN, "stdin"); err != nil {
+				return fmt.Errorf("can't merge config from stdin: %s", err.Error())
+			}
+			continue
+		}
+		err, found := c.LoadFile(path)
+		if !found {
+			return fmt.Errorf("can't open config file %s", path)
+		}
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// loadJSONArg merges the JSON config with the given path or STDIN for -
+func (c *Config) loadJSONArg(path string) error {
+	if path == "-" {
+		if err := c.MergeJSON(STDIN, "stdin"); err != nil {
+			return fmt.Errorf("can't merge JSON config from stdin: %s", err.Error())
+		}
+		return nil
+	}
+	file, err := c.fileSystem().Open(path)
+	if err != nil {
+		return fmt.Errorf("can't open JSON config file %s", path)
+	}
+	defer file.Close()
+	return c.MergeJSON(file, path)
+}
+
+// Warn is called with warnings, e.g. about config files that are skipped
+// (see SetLenientFiles). By default, the warnings are written to os.Stderr.
+var Warn = func(msg string) {
+	fmt.Fprintf(os.Stderr, "Warning: %s\n", msg)
+}
+
+// SetLenientFiles sets, if global, user and local config files that can't be
+// merged (e.g. because they are truncated) are skipped with a warning (see Warn)
+// instead of failing. Explicitly given files (e.g. via --config-file) still fail.
+// SetLenientFiles affects the config and its commands and is chainable.
+func (c *Config) SetLenientFiles(lenient bool) *Config {
+	c.lenientFiles = lenient
+	return c
+}
+
+// isLenient reports, if config files that can't be merged are skipped, see SetLenientFiles
+func (c *Config) isLenient() bool {
+	if c.parent != nil {
+		return c.parent.isLenient()
+	}
+	return c.lenientFiles
+}
+
+// IntrospectionFlags are the special commandline flags that print internals of the
+// config, see SetIntrospectionFlags
+var IntrospectionFlags = map[string]bool{
+	"config-spec":      true,
+	"config-env":       true,
+	"config-locations": true,
+	"config-files":     true,
+	"debug-config":     true,
+	"export-env":       true,
+}
+
+// SetIntrospectionFlags enables or disables the introspection flags (see IntrospectionFlags)
+// of the config and its commands. If flags are given, only these flags are enabled or
+// disabled, otherwise all of them. Disabled flags are not listed in the help and are
+// handled like any other (unknown) option. By default, all flags are enabled.
+// SetIntrospectionFlags is chainable.
+func (c *Config) SetIntrospectionFlags(enabled bool, flags ...string) *Config {
+	if len(flags) == 0 {
+		for flag := range IntrospectionFlags {
+			flags = append(flags, flag)
+		}
+	}
+	if c.disabledFlags == nil {
+		c.disabledFlags = map[string]bool{}
+	}
+	for _, flag := range flags {
+		if enabled {
+			delete(c.disabledFlags, flag)
+		} else {
+			c.disabledFlags[flag] = true
+		}
+	}
+	return c
+}
+
+// isFlagDisabled reports, if the given introspection flag is disabled, see SetIntrospectionFlags
+func (c *Config) isFlagDisabled(flag string) bool {
+	if c.parent != nil {
+		return c.parent.isFlagDisabled(flag)
+	}
+	return c.disabledFlags[flag]
+}
+
+// SetStrictFiles sets how unknown keys inside config files are handled.
+// If strict is true, any key that is not an option of the app or of its commands
+// results in an error. If strict is false, unknown keys (including keys of unknown
+// commands) are skipped with a warning (see Warn), e.g. for files with options that
+// have been removed in newer versions.
+// If SetStrictFiles is not called, unknown options of the app are ignored silently,
+// while unknown options of commands and unknown commands result in an error.
+// SetStrictFiles affects the config and its commands and is chainable.
+func (c *Config) SetStrictFiles(strict bool) *Config {
+	c.strictFiles = &strict
+	return c
+}
+
+// strictness returns the setting of SetStrictFiles, set is false if it was not called
+func (c *Config) strictness() (strict, set bool) {
+	if c.parent != nil {
+		return c.parent.strictness()
+	}
+	if c.strictFiles == nil {
+		return false, false
+	}
+	return *c.strictFiles, true
+}
+
+// SetLenientValues sets, if values inside config files that are invalid for the option
+// (e.g. because the file was written by another version of the app) are skipped with
+// a warning (see Warn) instead of failing. The skipped values are listed in the
+// LoadReport. Syntax errors and unknown options (see SetStrictFiles) are not affected.
+// SetLenientValues affects the config and its commands (also if called on a command)
+// and is chainable.
+func (c *Config) SetLenientValues(lenient bool) *Config {
+	if c.parent != nil {
+		c.parent.SetLenientValues(lenient)
+		return c
+	}
+	c.lenientValues = lenient
+	return c
+}
+
+// skipsInvalidValues reports, if invalid values of config files are skipped, see SetLenientValues
+func (c *Config) skipsInvalidValues() bool {
+	if c.parent != nil {
+		return c.parent.skipsInvalidValues()
+	}
+	return c.lenientValues
+}
+
+// SkippedValue is a value of a config file that has been skipped, see SetLenientValues
+type SkippedValue struct {
+	// Option is the key inside the config file, i.e. options of commands are
+	// prefixed with the command name
+	Option   string
+	Value    string
+	Location string
+	// FileVersion is the version in the header of the config file
+	FileVersion string
+	// VersionSkew is true, if the file has been written for another version than the
+	// running one, so that the value is likely stale. Otherwise the value is invalid
+	// for the running version, too.
+	VersionSkew bool
+	Err         error
+}
+
+// LoadReport reports the result of loading the config
+type LoadReport struct {
+	// Files are the absolute paths of the merged config files, see LoadedFiles
+	Files []string
+	// Skipped are the skipped values of config files, see SetLenientValues
+	Skipped []SkippedValue
+}
+
+// LoadReport returns the report of the config files merged by the last Load.
+// For commands, the report of the app is returned, since the app loads the files.
+func (c *Config) LoadReport() LoadReport {
+	if c.parent != nil {
+		return c.parent.LoadReport()
+	}
+	return LoadReport{
+		Files:   c.LoadedFiles(),
+		Skipped: append([]SkippedValue{}, c.skippedValues...),
+	}
+}
+
+// loadSourceFile loads a global, user or local config file like LoadFile.
+// If files are lenient, a file that can't be merged is skipped with a warning
+// and the values are restored to the state before the file was loaded.
+func (c *Config) loadSourceFile(path string) (err error, found bool) {
+	if !c.isLenient() {
+		return c.LoadFile(path)
+	}
+	restore := c.snapshot()
+	err, found = c.LoadFile(path)
+	if err != nil {
+		restore()
+		Warn(fmt.Sprintf("skipping config file %s: %s", path, err.Error()))
+		return nil, found
+	}
+	return
+}
+
+// snapshot copies the values and locations of the config and its commands and
+// returns a function that restores them
+func (c *Config) snapshot() (restore func()) {
+	values := make(map[string]interface{}, len(c.values))
+	for k, v := range c.values {
+		values[k] = v
+	}
+	locations := make(map[string][]string, len(c.locations))
+	for k, v := range c.locations {
+		locations[k] = v
+	}
+	explicitSet := make(map[string]bool, len(c.explicitSet))
+	for k, v := range c.explicitSet {
+		explicitSet[k] = v
+	}
+	loadedFiles := c.loadedFiles
+	skippedValues := c.skippedValues
+	var restoreSubs []func()
+	c.EachSub(func(name string, sub *Config) {
+		restoreSubs = append(restoreSubs, sub.snapshot())
+	})
+	return func() {
+		c.values = values
+		c.locations = locations
+		c.explicitSet = explicitSet
+		c.loadedFiles = loadedFiles
+		c.skippedValues = skippedValues
+		for _, fn := range restoreSubs {
+			fn()
+		}
+	}
+}
+
 // LoadUser loads the user specific config file
 func (c *Config) LoadUser() error {
-	err, found := c.LoadFile(c.UserFile())
-	if found {
-		return err
-	}
-	return nil
+	return c.loadFirstSourceFile(SourceUser)
+}
+
+// LoadRuntime loads the config file inside the RUNTIME_DIR (see RuntimeFile).
+// If RUNTIME_DIR is not set or there is no such file, nothing is loaded.
+func (c *Config) LoadRuntime() error {
+	return c.loadFirstSourceFile(SourceRuntime)
 }
 
 // LoadLocals merges config inside a .config subdir in the local directory
+// (or in a parent directory, see SearchLocalInParents)
 func (c *Config) LoadLocals() error {
-	// fmt.Println("loading locals from " + c.LocalFile())
-	err, found := c.LoadFile(c.LocalFile())
-	if found {
-		return err
-	}
-	return nil
+	return c.loadFirstSourceFile(SourceLocals)
 }
 
 // LoadGlobals loads the first config file for the app it could find inside
 // the GLOBAL_DIRS and returns an error if the config could not be merged properly
 // If no config file could be found, no error is returned.
 func (c *Config) LoadGlobals() error {
-	for _, dir := range splitGlobals() {
-		err, found := c.LoadFile(filepath.Join(dir, c.appName(), c.appName()+CONFIG_EXT))
+	return c.loadFirstSourceFile(SourceGlobals)
+}
+
+// loadFirstSourceFile loads the first config file of the given source (see sourceFiles)
+// that could be found. If no config file could be found, no error is returned.
+func (c *Config) loadFirstSourceFile(src Source) error {
+	for _, path := range c.sourceFiles(src) {
+		err, found := c.loadSourceFile(path)
 		if found {
 			return err
 		}
@@ -132,11 +543,412 @@ func (c *Config) LoadDefaults() {
 	for k, spec := range c.spec {
 		if spec.Default != nil {
 			c.values[k] = spec.Default
-			c.locations[k] = append(c.locations[k], fmt.Sprintf("%v", spec.Default))
+			if path, is := spec.Default.(string); is {
+				if expanded, err := spec.expandPath(path, c.pathLookup); err == nil {
+					c.values[k] = expanded
+				}
+			}
+			c.locations[k] = append(c.locations[k], defaultLocation(spec.Default))
+		}
+		if spec.DefaultEnv == "" {
+			continue
+		}
+		if val := strings.TrimSpace(lookupEnv(c.environ(), spec.DefaultEnv)); val != "" {
+			v, err := c.parseValue(k, val)
+			if err != nil {
+				Warn(fmt.Sprintf("ignoring env variable %s as default of option %s: %s", spec.DefaultEnv, k, err.Error()))
+				continue
+			}
+			c.values[k] = v
+			c.locations[k] = append(c.locations[k], "default from env "+spec.DefaultEnv)
 		}
 	}
 }
 
+// CommandTimeout is the timeout for the commands of options, see FromCommand
+var CommandTimeout = 10 * time.Second
+
+// resolveFromCommands sets the unset options that get their value from a
+// command (see FromCommand) to the output of the command
+func (c *Config) resolveFromCommands() error {
+	for k, spec := range c.spec {
+		if len(spec.FromCommand) == 0 {
+			continue
+		}
+		if _, has := c.values[k]; has {
+			continue
+		}
+		out, err := runCommand(spec.FromCommand)
+		if err != nil {
+			return CommandOutputError{k, spec.FromCommand, err}
+		}
+		if err := c.set(k, out, "command "+strings.Join(spec.FromCommand, " ")); err != nil {
+			return CommandOutputError{k, spec.FromCommand, err}
+		}
+	}
+	return nil
+}
+
+// runCommand runs the command given by argv with the CommandTimeout and
+// returns its output without trailing newlines. Errors contain the output of
+// the command to stderr.
+func runCommand(argv []string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CommandTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("timeout after %s", CommandTimeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %s", err.Error(), msg)
+		}
+		return "", err
+	}
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
+
+// resolveDefaultsFrom sets the unset options that default to other options
+// (see DefaultFromOption) to the values of these options
+func (c *Config) resolveDefaultsFrom() error {
+	for k, spec := range c.spec {
+		if spec.DefaultFrom != "" {
+			if err := c.resolveDefaultFrom(k, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolveDefaultFrom resolves the default of the given option after resolving the
+// option it defaults to. path tracks the options that are currently resolved to
+// detect cycles.
+func (c *Config) resolveDefaultFrom(option string, path []string) error {
+	for i, p := range path {
+		if p == option {
+			return DefaultCycleError(append(path[i:], option))
+		}
+	}
+	spec := c.spec[option]
+	if spec.DefaultFrom == "" {
+		return nil
+	}
+	from, has := c.spec[spec.DefaultFrom]
+	if !has {
+		return UnknownOptionError{c.version, spec.DefaultFrom}
+	}
+	// resolve the whole chain first, so that cycles are detected regardless of the values
+	if err := c.resolveDefaultFrom(from.Name, append(path, option)); err != nil {
+		return err
+	}
+	if _, has := c.values[option]; has {
+		return nil
+	}
+	v, has := c.values[from.Name]
+	if !has {
+		return nil
+	}
+	if err := spec.ValidateValue(v); err != nil {
+		return InvalidDefault{option, spec.Type, v}
+	}
+	c.values[option] = v
+	c.locations[option] = append(c.locations[option], "default from "+from.Name)
+	return nil
+}
+
+// SetFileReferences enables references to the values of keys that are defined
+// before inside the same config file, e.g.
+//
+//	$host=localhost
+//	$port=8080
+//	$baseurl=http://${host}:${port}
+//
+// Options of commands are referenced with their key, e.g. ${project_title}.
+// References to keys that are not defined before inside the file result in an error.
+// SetFileReferences affects the config and its commands and is chainable.
+func (c *Config) SetFileReferences(enabled bool) *Config {
+	c.fileRefs = enabled
+	return c
+}
+
+// fileReferences reports, if references inside config files are resolved, see SetFileReferences
+func (c *Config) fileReferences() bool {
+	if c.parent != nil {
+		return c.parent.fileReferences()
+	}
+	return c.fileRefs
+}
+
+// resolveFileReferences replaces the references inside the value of the given key
+// with the values of the keys that are defined before
+func resolveFileReferences(key, val string, values map[string]string) (string, error) {
+	return replaceReferences(fileReferenceRegExp, val, func(name string) (string, error) {
+		v, has := values[name]
+		if !has {
+			return "", UndefinedReferenceError{key, name}
+		}
+		return v, nil
+	})
+}
+
+// SetInterpolation enables references to other options inside the values of string
+// and json options, e.g. the value ${basedir}/logs refers to the option basedir.
+// The references are resolved after all values have been loaded. Undefined references
+// and cycles result in an error. SetInterpolation affects the config and its commands
+// and is chainable.
+func (c *Config) SetInterpolation(enabled bool) *Config {
+	c.interpolation = enabled
+	return c
+}
+
+// interpolates reports, if references to other options are resolved, see SetInterpolation
+func (c *Config) interpolates() bool {
+	if c.parent != nil {
+		return c.parent.interpolates()
+	}
+	return c.interpolation
+}
+
+// pathLookup returns the value of the env variable with the given name for the
+// expansion of paths. References to options are kept for resolveReferences.
+func (c *Config) pathLookup(name string) string {
+	if _, has := c.spec[name]; has && c.interpolates() {
+		return "${" + name + "}"
+	}
+	return lookupEnv(c.environ(), name)
+}
+
+// referenceRegExp matches references to options, see SetInterpolation
+var referenceRegExp = regexp.MustCompile(`\$\{([a-z][a-z0-9]+)\}`)
+
+// fileReferenceRegExp matches references to keys of config files, i.e. also to keys of
+// options of commands ([command]_[option]), see SetFileReferences
+var fileReferenceRegExp = regexp.MustCompile(`\$\{([a-z][a-z0-9]+(_[a-z][a-z0-9]+)?)\}`)
+
+// replaceReferences replaces the references matched by re inside val with the values
+// returned by lookup for the referenced names. The first error of lookup is returned.
+func replaceReferences(re *regexp.Regexp, val string, lookup func(name string) (string, error)) (string, error) {
+	var err error
+	out := re.ReplaceAllStringFunc(val, func(ref string) string {
+		if err != nil {
+			return ref
+		}
+		var v string
+		if v, err = lookup(ref[2 : len(ref)-1]); err != nil {
+			return ref
+		}
+		return v
+	})
+	return out, err
+}
+
+// resolveReferences resolves the references to other options, if interpolation is enabled
+func (c *Config) resolveReferences() error {
+	if !c.interpolates() {
+		return nil
+	}
+	names := make([]string, 0, len(c.values))
+	for k := range c.values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	resolved := map[string]bool{}
+	for _, k := range names {
+		if err := c.resolveReference(k, nil, resolved); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveReference resolves the references inside the value of the given option after
+// resolving the referenced options. path tracks the options that are currently
+// resolved to detect cycles.
+func (c *Config) resolveReference(option string, path []string, resolved map[string]bool) error {
+	if resolved[option] {
+		return nil
+	}
+	for i, p := range path {
+		if p == option {
+			return ReferenceCycleError(append(path[i:], option))
+		}
+	}
+	spec := c.spec[option]
+	str, isString := c.values[option].(string)
+	if !isString || (spec.Type != "string" && spec.Type != "json") {
+		resolved[option] = true
+		return nil
+	}
+
+	out, err := replaceReferences(referenceRegExp, str, func(name string) (string, error) {
+		if _, has := c.values[name]; !has {
+			return "", UndefinedReferenceError{option, name}
+		}
+		if err := c.resolveReference(name, append(path, option), resolved); err != nil {
+			return "", err
+		}
+		if s, is := c.values[name].(string); is {
+			return s, nil
+		}
+		return fmt.Sprintf("%v", c.values[name]), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if out != str {
+		if err := spec.ValidateValue(out); err != nil {
+			return err
+		}
+		c.values[option] = out
+	}
+	resolved[option] = true
+	return nil
+}
+
+// SetDefaultsFS sets a config file inside the given fs (e.g. an embed.FS) that is
+// loaded by Load after the defaults and before the global config files.
+// SetDefaultsFS is chainable.
+func (c *Config) SetDefaultsFS(fsys fs.FS, path string) *Config {
+	c.defaultsFS = fsys
+	c.defaultsFSPath = path
+	return c
+}
+
+// LoadDefaultsFS merges the config file set via SetDefaultsFS.
+// If no such file has been set, nothing happens.
+func (c *Config) LoadDefaultsFS() error {
+	if c.defaultsFS == nil {
+		return nil
+	}
+	return MergeFS(c, c.defaultsFS, c.defaultsFSPath, c.defaultsFSPath)
+}
+
+// MergeFS merges the config from the file with the given path inside the given fs
+// and returns any error happening while opening or merging the file
+func MergeFS(c *Config, fsys fs.FS, path, location string) error {
+	file, err := fsys.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := c.Merge(file, location); err != nil {
+		return fmt.Errorf("can't merge file %s: %s", location, err.Error())
+	}
+	return nil
+}
+
+var (
+	// URLTimeout is the timeout for fetching config files via MergeURL
+	URLTimeout = 10 * time.Second
+
+	// MaxURLSize is the maximal size in bytes of config files fetched via MergeURL
+	MaxURLSize int64 = 1 << 20
+)
+
+// MergeURL fetches the config file from the given http(s) url and merges it.
+// Any response with another status than 200 OK results in an error, as well as
+// config files larger than MaxURLSize. See URLTimeout for the timeout and
+// MergeURLVerified for the verification of a checksum.
+func MergeURL(c *Config, rawurl, location string) error {
+	data, err := fetchURL(rawurl)
+	if err != nil {
+		return err
+	}
+	return mergeURLData(c, data, rawurl, location)
+}
+
+// MergeURLVerified is like MergeURL, but merges the fetched config file only, if its
+// SHA-256 checksum matches the given hex encoded expectedHash. Otherwise nothing is
+// merged and a ChecksumError is returned.
+func MergeURLVerified(c *Config, rawurl, location, expectedHash string) error {
+	data, err := fetchURL(rawurl)
+	if err != nil {
+		return err
+	}
+	if err := verifyChecksum(data, expectedHash, rawurl); err != nil {
+		return err
+	}
+	return mergeURLData(c, data, rawurl, location)
+}
+
+// mergeURLData merges the config file data that has been fetched from rawurl
+func mergeURLData(c *Config, data []byte, rawurl, location string) error {
+	if err := c.Merge(bytes.NewReader(data), location); err != nil {
+		return fmt.Errorf("can't merge config from %s: %s", rawurl, err.Error())
+	}
+	return nil
+}
+
+// fetchURL fetches the config file from the given http(s) url, see MergeURL
+func fetchURL(rawurl string) ([]byte, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("can't fetch config from %s: unsupported scheme %#v", rawurl, u.Scheme)
+	}
+
+	client := &http.Client{Timeout: URLTimeout}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch config from %s: %s", rawurl, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("can't fetch config from %s: %s", rawurl, resp.Status)
+	}
+
+	if resp.ContentLength > MaxURLSize {
+		return nil, fmt.Errorf("can't fetch config from %s: size exceeds %d bytes", rawurl, MaxURLSize)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxURLSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch config from %s: %s", rawurl, err.Error())
+	}
+	if int64(len(data)) > MaxURLSize {
+		return nil, fmt.Errorf("can't fetch config from %s: size exceeds %d bytes", rawurl, MaxURLSize)
+	}
+	return data, nil
+}
+
+// LoadFileVerified merges the config from the given file, if the SHA-256 checksum
+// of the file matches the given hex encoded expectedHash. Otherwise nothing is merged
+// and a ChecksumError is returned. In contrast to LoadFile, a missing file is an error.
+func LoadFileVerified(c *Config, path string, expectedHash string) error {
+	path = filepath.FromSlash(path)
+	data, err := c.fileSystem().ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := verifyChecksum(data, expectedHash, path); err != nil {
+		return err
+	}
+	if err := c.Merge(bytes.NewReader(data), path); err != nil {
+		return fmt.Errorf("can't merge file %s: %s", path, err.Error())
+	}
+	return nil
+}
+
+// verifyChecksum checks if the SHA-256 checksum of data matches the hex encoded expectedHash
+func verifyChecksum(data []byte, expectedHash string, location string) error {
+	sum := sha256.Sum256(data)
+	got := hex.EncodeToString(sum[:])
+	if !strings.EqualFold(got, strings.TrimSpace(expectedHash)) {
+		return ChecksumError{location, expectedHash, got}
+	}
+	return nil
+}
+
 // LoadFile merges the config from the given file and returns any error happening during the merge
 // If the file could not be opened (does not exist), no error is returned
 // TODO maybe an error should be returned, if the file exists, but could not be opened because
@@ -144,7 +956,7 @@ func (c *Config) LoadDefaults() {
 func (c *Config) LoadFile(path string) (err error, found bool) {
 	//fmt.Printf("before from slash: %#v\n",path)
 	path = filepath.FromSlash(path)
-	file, err0 := os.Open(path)
+	file, err0 := c.fileSystem().Open(path)
 	if err0 != nil {
 		//fmt.Printf("missing file: %#v: %s\n",path, err0)
 		return nil, false
@@ -154,25 +966,42 @@ func (c *Config) LoadFile(path string) (err error, found bool) {
 	//fmt.Printf("merging: %#v\n",path)
 	err1 := c.Merge(file, path)
 	if err1 != nil {
-		err = fmt.Errorf("can't merge file %s: %s", file.Name(), err1.Error())
+		err = fmt.Errorf("can't merge file %s: %s", path, err1.Error())
+		return
+	}
+	if abs, errAbs := filepath.Abs(path); errAbs == nil {
+		c.loadedFiles = append(c.loadedFiles, abs)
+	} else {
+		c.loadedFiles = append(c.loadedFiles, path)
 	}
 	return
 }
 
+// LoadedFiles returns the absolute paths of the config files that have been
+// merged by the last Load, in the order they were merged
+func (c *Config) LoadedFiles() []string {
+	return append([]string{}, c.loadedFiles...)
+}
+
 // Load loads the config values in the following order where
 // each loader overwrittes corresponding config keys that have been defined
+// (global, user, runtime, local and env config may be reordered via SetPrecedence)
 /*
 	defaults
 	global config
 	user config
+	runtime config
 	local config
 	env config
+	config file given via --config-file
 	args config
 */
-// in the args config any wrong syntax or values result in writing the error to StdErr and
-// exiting the program. also if --config_spec is set the spec is directly written to the
-// StdOut and the program is exiting. If --help is set, the help message is printed with the
-// the help  messages for the config options
+// Errors of loading, including wrong syntax or values in the args config, are returned to
+// the caller instead of exiting the program.
+// The meta args however print their output and exit the program, e.g. if --config-spec
+// is set, the spec is directly written to the StdOut and the program is exiting, and
+// --config-validate exits with a nonzero exit code for an invalid config. If --help is set,
+// the help message is printed with the help messages for the config options
 func (c *Config) Run() error {
 	return c.Load(true)
 }
@@ -1,7 +1,12 @@
 package config
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
 	"time"
 )
 
@@ -37,6 +42,19 @@ func (c *Config) NewString(name, helpText string, opts ...func(*Option)) StringG
 	}
 }
 
+// shortcut for MustNewOption of type string for options that are paths.
+// A leading ~ is expanded to the home dir of the user and $VAR or ${VAR} to the
+// value of the env variable, unless NoExpand is set.
+func (c *Config) NewPath(name, helpText string, opts ...func(*Option)) StringGetter {
+	return StringGetter{
+		opt: c.MustNewOption(name, "string", helpText, append([]func(*Option){isPath}, opts...)),
+		cfg: c,
+	}
+}
+
+// isPath marks the option as path, see NewPath
+func isPath(o *Option) { o.Path = true }
+
 // shortcut for MustNewOption of type datetime
 func (c *Config) NewDateTime(name, helpText string, opts ...func(*Option)) DateTimeGetter {
 	return DateTimeGetter{
@@ -45,6 +63,23 @@ func (c *Config) NewDateTime(name, helpText string, opts ...func(*Option)) DateT
 	}
 }
 
+// shortcut for MustNewOption of type binary. The values are base64 encoded
+// inside config files, env variables and args.
+func (c *Config) NewBinary(name, helpText string, opts ...func(*Option)) BinaryGetter {
+	return BinaryGetter{
+		opt: c.MustNewOption(name, "binary", helpText, opts),
+		cfg: c,
+	}
+}
+
+// shortcut for MustNewOption of type list
+func (c *Config) NewList(name, helpText string, opts ...func(*Option)) ListGetter {
+	return ListGetter{
+		opt: c.MustNewOption(name, "list", helpText, opts),
+		cfg: c,
+	}
+}
+
 func (c *Config) NewDate(name, helpText string, opts ...func(*Option)) DateTimeGetter {
 	return DateTimeGetter{
 		opt: c.MustNewOption(name, "date", helpText, opts),
@@ -67,8 +102,23 @@ func (c *Config) NewJSON(name, helpText string, opts ...func(*Option)) JSONGette
 	}
 }
 
+// Secret marks the option as secret, so that its input is not echoed by PromptMissing
+// and its value is masked by WriteCompact and --debug-config.
+func Secret(o *Option) { o.Secret = true }
+
+// NoExpand prevents the expansion of ~ and env variables inside the values of a path option, see NewPath.
+func NoExpand(o *Option) { o.NoExpand = true }
+
+// Required marks the option as required. Required options should not have a default,
+// since the default always satisfies the requirement (a warning is issued, see Warn).
 func Required(o *Option) { o.Required = true }
 
+// RequiredMessage sets a hint that is added to the error, if the required option
+// is missing, e.g. "set --token or the MYAPP_CONFIG_TOKEN env variable".
+func RequiredMessage(msg string) func(*Option) {
+	return func(o *Option) { o.RequiredMessage = msg }
+}
+
 func Default(val interface{}) func(*Option) {
 	return func(o *Option) { o.Default = val }
 }
@@ -77,6 +127,84 @@ func Shortflag(s rune) func(*Option) {
 	return func(o *Option) { o.Shortflag = string(s) }
 }
 
+// ListSeparator sets the separator that splits the values of a list option (default is a comma).
+// The separator is used for commandline flags, env variables and config files alike.
+// If sep is the empty string, the values are not split. Instead every occurrence of the
+// commandline flag adds one value, while env variables and config files have one value per line.
+func ListSeparator(sep string) func(*Option) {
+	return func(o *Option) {
+		o.Separator = sep
+		o.NoSplit = sep == ""
+	}
+}
+
+// FromCommand lets the option get its value from the output to stdout of the
+// command given by argv (e.g. to read secrets from a password manager), if it is
+// not set otherwise. The command is run by Load with a timeout, see CommandTimeout.
+func FromCommand(argv ...string) func(*Option) {
+	return func(o *Option) { o.FromCommand = argv }
+}
+
+// Transform adds a function that transforms the raw string value of the option
+// before it is parsed, e.g. to expand paths or to trim quotes. It applies to values
+// from all sources (config files, env variables, args etc.). Multiple transforms run
+// in the order they were added. See also SetTransform for transforming parsed values.
+func Transform(fn func(string) (string, error)) func(*Option) {
+	return func(o *Option) { o.Transforms = append(o.Transforms, fn) }
+}
+
+// DefaultFromEnv lets the option default to the value of the env variable with the
+// given name (see ENV and SetEnv), e.g. EDITOR, if it is set and not empty. Otherwise
+// fallback is the default (may be nil). This is independent from the env variables of MergeEnv.
+func DefaultFromEnv(envName string, fallback interface{}) func(*Option) {
+	return func(o *Option) {
+		o.DefaultEnv = envName
+		o.Default = fallback
+	}
+}
+
+// DefaultFromOption lets the option default to the value of the option with the
+// given name, if it is not set otherwise (e.g. bindhost defaulting to host).
+// Both options must have the same type.
+func DefaultFromOption(name string) func(*Option) {
+	return func(o *Option) { o.DefaultFrom = name }
+}
+
+// HelpFunc sets a function that generates the help text of the option when the
+// help is printed, e.g. to list plugins that are discovered at runtime.
+// The static help text may then be empty.
+func HelpFunc(fn func() string) func(*Option) {
+	return func(o *Option) { o.HelpFn = fn }
+}
+
+// JSONSchema sets a JSON Schema that the values of a json option must conform to.
+// The schema is compiled when the option is created, see jsonSchema for the
+// supported keywords.
+func JSONSchema(schema string) func(*Option) {
+	return func(o *Option) { o.Schema = schema }
+}
+
+// RelaxedJSON allows relaxed JSON for the values of a json option: keys may be unquoted,
+// strings may be single quoted, trailing commas and comments (// and /* */) are allowed.
+// The values are stored as strict JSON.
+func RelaxedJSON() func(*Option) {
+	return func(o *Option) { o.RelaxedJSON = true }
+}
+
+// AltNames registers alternative names for the option, e.g. "colour" for "color".
+// The alternative names are accepted for commandline flags, env variables and
+// config files alike. They must not collide with other options or alternative names.
+func AltNames(names ...string) func(*Option) {
+	return func(o *Option) { o.AltNames = append(o.AltNames, names...) }
+}
+
+// Positional binds the option additionally to the positional commandline argument
+// at the given position (starting with 1). If the option is also given as flag,
+// the flag takes precedence, but the values must not differ.
+func Positional(pos int) func(*Option) {
+	return func(o *Option) { o.Position = pos }
+}
+
 /*
 TODO
 create this function to allow handling of stdin
@@ -102,14 +230,53 @@ func (c *Config) NewOption(name, type_, helpText string, opts []func(*Option)) (
 		s(o)
 	}
 
-	if err := o.Validate(); err != nil {
+	if err := c.registerOption(o); err != nil {
 		return nil, err
 	}
+	return o, nil
+}
 
-	if err := c.addOption(o); err != nil {
-		return nil, err
+// AddOptions validates and adds copies of the given options, e.g. for specs that are
+// only known at runtime. The options are added in the given order. The first error
+// is returned together with the name of the failing option; the options before it
+// remain added.
+func (c *Config) AddOptions(opts []Option) error {
+	for i := range opts {
+		o := opts[i]
+		if err := c.registerOption(&o); err != nil {
+			return fmt.Errorf("can't add option %#v: %s", o.Name, err.Error())
+		}
 	}
-	return o, nil
+	return nil
+}
+
+// registerOption converts the default to the type of the option (see normalizeDefault),
+// compiles the schema of the option, validates and adds it
+func (c *Config) registerOption(o *Option) error {
+	if err := o.normalizeDefault(); err != nil {
+		return err
+	}
+
+	if o.Schema != "" {
+		if o.Type != "json" {
+			return fmt.Errorf("json schema for option %s of type %s", o.Name, o.Type)
+		}
+		schema, err := compileSchema(o.Schema)
+		if err != nil {
+			return err
+		}
+		o.schema = schema
+	}
+
+	if err := o.Validate(); err != nil {
+		return err
+	}
+
+	if o.Required && o.Default != nil {
+		Warn(fmt.Sprintf("option %s is required and has a default, which makes the requirement meaningless", o.Name))
+	}
+
+	return c.addOption(o)
 }
 
 type Option struct {
@@ -119,22 +286,155 @@ type Option struct {
 	// A name must at least have one word
 	Name string `json:"name"`
 
-	// Required indicates, if the Option is required
+	// Required indicates, if the Option is required.
+	// The Default of a required Option satisfies the requirement, so that a required
+	// Option with a Default is never missing.
 	Required bool `json:"required"`
 
-	// Type must be one of "bool","int32","float32","string","datetime","json"
+	// RequiredMessage is added to the error for a missing required Option, see RequiredMessage
+	RequiredMessage string `json:"requiredmessage,omitempty"`
+
+	// Secret indicates, if the value of the Option is secret, see Secret
+	Secret bool `json:"secret,omitempty"`
+
+	// Path indicates, if the value of the Option is a path, see NewPath
+	Path bool `json:"path,omitempty"`
+
+	// NoExpand prevents the expansion of paths, see NoExpand
+	NoExpand bool `json:"noexpand,omitempty"`
+
+	// Type must be one of "bool","int32","float32","string","datetime","date","time","json","list","binary"
 	Type string `json:"type"`
 
 	// The Help string is part of the documentation
 	Help string `json:"help"`
 
+	// Transforms transform the raw string values before they are parsed, see Transform
+	Transforms []func(string) (string, error) `json:"-"`
+
+	// HelpFn generates the help text when it is printed, see HelpFunc
+	HelpFn func() string `json:"-"`
+
 	// The Default value for the Config. The value might be nil for optional Options.
 	// Otherwise, it must have the same type as the Type property indicates
 	Default interface{} `json:"default,omitempty"`
 
+	// FromCommand is the command whose output is the value of this Option, if it is
+	// not set otherwise, see FromCommand
+	FromCommand []string `json:"fromcommand,omitempty"`
+
+	// DefaultEnv is the name of an env variable whose value is the default, see DefaultFromEnv
+	DefaultEnv string `json:"defaultenv,omitempty"`
+
+	// DefaultFrom is the name of an Option whose value is the default for this Option,
+	// see DefaultFromOption
+	DefaultFrom string `json:"defaultfrom,omitempty"`
+
 	// A Shortflag for the Option. Shortflags may only be used for commandline flags
 	// They must be a single lowercase ascii character
 	Shortflag string `json:"shortflag,omitempty"`
+
+	// Position binds the Option additionally to a positional commandline argument.
+	// Positions start with 1, 0 means that the Option is no positional argument.
+	Position int `json:"position,omitempty"`
+
+	// Schema is a JSON Schema for the values of json Options, see JSONSchema
+	Schema string `json:"schema,omitempty"`
+	schema *jsonSchema
+
+	// RelaxedJSON allows relaxed JSON for json Options, see RelaxedJSON
+	RelaxedJSON bool `json:"relaxedjson,omitempty"`
+
+	// AltNames are alternative names of the Option, see AltNames
+	AltNames []string `json:"altnames,omitempty"`
+
+	// Separator splits the values of list Options. If it is empty, a comma is used.
+	Separator string `json:"separator,omitempty"`
+
+	// NoSplit prevents the splitting of commandline flags for list Options, see ListSeparator
+	NoSplit bool `json:"nosplit,omitempty"`
+}
+
+// helpText returns the help text of the option, see HelpFunc
+func (c Option) helpText() string {
+	if c.HelpFn != nil {
+		return c.HelpFn()
+	}
+	return c.Help
+}
+
+// EnvName returns the name of the env variable for the Option, where prefix is the
+// name of the app (or [app]_[command] for options of commands), e.g. MYAPP_CONFIG_NAME
+func (c Option) EnvName(prefix string) string {
+	return envPrefix(prefix) + strings.ToUpper(c.Name)
+}
+
+// FlagName returns the commandline flag for the Option, e.g. --name
+func (c Option) FlagName() string {
+	return keyToArg(c.Name)
+}
+
+// expandPath expands the given value with the given lookup of variables, if the
+// option is a path that should be expanded
+func (c Option) expandPath(value string, lookup func(string) string) (string, error) {
+	if !c.Path || c.NoExpand {
+		return value, nil
+	}
+	return expandPath(value, lookup)
+}
+
+// listSeparator returns the separator for the values of list Options inside env
+// variables and config files
+func (c Option) listSeparator() string {
+	if c.NoSplit {
+		return "\n"
+	}
+	if c.Separator == "" {
+		return ","
+	}
+	return c.Separator
+}
+
+// sameDefinition checks if both options are defined the same way, ignoring the help text
+func (c *Option) sameDefinition(other *Option) bool {
+	return c.Name == other.Name &&
+		c.Type == other.Type &&
+		c.Required == other.Required &&
+		c.Shortflag == other.Shortflag &&
+		c.Position == other.Position &&
+		c.Path == other.Path &&
+		c.NoExpand == other.NoExpand &&
+		c.DefaultFrom == other.DefaultFrom &&
+		c.DefaultEnv == other.DefaultEnv &&
+		strings.Join(c.FromCommand, " ") == strings.Join(other.FromCommand, " ") &&
+		c.Schema == other.Schema &&
+		strings.Join(c.AltNames, ",") == strings.Join(other.AltNames, ",") &&
+		c.listSeparator() == other.listSeparator() &&
+		reflect.DeepEqual(c.Default, other.Default)
+}
+
+// validateSchema validates the unmarshalled json value v against the
+// JSON Schema of the option, if there is one
+func (c Option) validateSchema(v interface{}) error {
+	if c.Schema == "" {
+		return nil
+	}
+	schema := c.schema
+	if schema == nil {
+		// e.g. for specs that have been unmarshalled from JSON
+		var err error
+		if schema, err = compileSchema(c.Schema); err != nil {
+			return err
+		}
+	}
+	if violation := schema.validate(v, ""); violation != nil {
+		path := violation.path
+		if path == "" {
+			path = "/"
+		}
+		return SchemaError{c.Name, path, violation.message}
+	}
+	return nil
 }
 
 // ValidateDefault checks if the default value is valid.
@@ -151,6 +451,54 @@ func (c Option) ValidateDefault() error {
 	return nil
 }
 
+// normalizeDefault converts a default that has been unmarshalled from JSON
+// (float64, string or []interface{}) to the type of the option.
+// Defaults that already have the right type are left untouched.
+func (c *Option) normalizeDefault() error {
+	invalidErr := InvalidDefault{c.Name, c.Type, c.Default}
+	switch ty := c.Default.(type) {
+	case float64:
+		switch c.Type {
+		case "int32":
+			if ty != math.Trunc(ty) || ty < math.MinInt32 || ty > math.MaxInt32 {
+				return invalidErr
+			}
+			c.Default = int32(ty)
+		case "float32":
+			c.Default = float32(ty)
+		}
+	case string:
+		switch c.Type {
+		case "date", "time", "datetime":
+			t, err := time.Parse(time.RFC3339Nano, ty)
+			if err != nil {
+				return invalidErr
+			}
+			c.Default = t
+		case "binary":
+			b, err := base64.StdEncoding.DecodeString(ty)
+			if err != nil {
+				return invalidErr
+			}
+			c.Default = b
+		}
+	case []interface{}:
+		if c.Type != "list" {
+			return invalidErr
+		}
+		list := make([]string, len(ty))
+		for i, v := range ty {
+			s, ok := v.(string)
+			if !ok {
+				return invalidErr
+			}
+			list[i] = s
+		}
+		c.Default = list
+	}
+	return nil
+}
+
 // ValidateValue checks if the given value is valid.
 // If it does, nil is returned, otherwise
 // ErrInvalidValue is returned or a json unmarshalling error if the type is json
@@ -186,6 +534,17 @@ func (c Option) ValidateValue(val interface{}) error {
 			if err := json.Unmarshal([]byte(ty), &v); err != nil {
 				return err
 			}
+			if err := c.validateSchema(v); err != nil {
+				return err
+			}
+		}
+	case []string:
+		if c.Type != "list" {
+			return invalidErr
+		}
+	case []byte:
+		if c.Type != "binary" {
+			return invalidErr
 		}
 	case time.Time:
 
@@ -215,8 +574,11 @@ func (c Option) Validate() error {
 	if err := c.ValidateDefault(); err != nil {
 		return err
 	}
-	if c.Help == "" {
+	if c.Help == "" && c.HelpFn == nil {
 		return ErrMissingHelp
 	}
+	if c.Position < 0 {
+		return ErrInvalidPosition
+	}
 	return nil
 }
@@ -0,0 +1,119 @@
+// +build windows
+
+package config
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// registryRoots are the predefined registry keys by name and abbreviation
+var registryRoots = map[string]syscall.Handle{
+	"HKEY_CLASSES_ROOT":   syscall.HKEY_CLASSES_ROOT,
+	"HKCR":                syscall.HKEY_CLASSES_ROOT,
+	"HKEY_CURRENT_USER":   syscall.HKEY_CURRENT_USER,
+	"HKCU":                syscall.HKEY_CURRENT_USER,
+	"HKEY_LOCAL_MACHINE":  syscall.HKEY_LOCAL_MACHINE,
+	"HKLM":                syscall.HKEY_LOCAL_MACHINE,
+	"HKEY_USERS":          syscall.HKEY_USERS,
+	"HKU":                 syscall.HKEY_USERS,
+	"HKEY_CURRENT_CONFIG": syscall.HKEY_CURRENT_CONFIG,
+	"HKCC":                syscall.HKEY_CURRENT_CONFIG,
+}
+
+// MergeRegistry merges the values of the registry key keypath below the given root
+// (e.g. "HKEY_CURRENT_USER" or "HKCU") into the config. The registry values are
+// mapped to the options by name. String values (REG_SZ and REG_EXPAND_SZ) are parsed
+// like env variables, DWORD values are treated as integers. If the key does not exist,
+// nothing is merged. Any invalid value results in an InvalidConfigRegistry error.
+func (c *Config) MergeRegistry(root, keypath string) error {
+	rootKey, has := registryRoots[strings.ToUpper(root)]
+	if !has {
+		return fmt.Errorf("unknown registry root %#v", root)
+	}
+
+	path, err := syscall.UTF16PtrFromString(keypath)
+	if err != nil {
+		return err
+	}
+
+	var key syscall.Handle
+	if err := syscall.RegOpenKeyEx(rootKey, path, 0, syscall.KEY_READ, &key); err != nil {
+		if err == syscall.ERROR_FILE_NOT_FOUND {
+			return nil
+		}
+		return err
+	}
+	defer syscall.RegCloseKey(key)
+
+	names := make([]string, 0, len(c.spec))
+	for name := range c.spec {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		location := root + `\` + keypath + `\` + name
+		val, found, err := readRegistryValue(key, name)
+		if err != nil {
+			return InvalidConfigRegistry{c.version, location, err}
+		}
+		if !found {
+			continue
+		}
+		val = strings.TrimSpace(val)
+		if val == "" {
+			return EmptyValueSourceError{EmptyValueError(name), SourceOther, location}
+		}
+		if err := c.set(name, val, location); err != nil {
+			return InvalidConfigRegistry{c.version, location, err}
+		}
+	}
+	return nil
+}
+
+// readRegistryValue reads the string or DWORD value with the given name of the opened key
+func readRegistryValue(key syscall.Handle, name string) (val string, found bool, err error) {
+	namep, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return "", false, err
+	}
+
+	var typ, n uint32
+	if err = syscall.RegQueryValueEx(key, namep, nil, &typ, nil, &n); err != nil {
+		if err == syscall.ERROR_FILE_NOT_FOUND {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+
+	if n == 0 {
+		return "", true, nil
+	}
+
+	buf := make([]byte, n)
+	if err = syscall.RegQueryValueEx(key, namep, nil, &typ, &buf[0], &n); err != nil {
+		return "", false, err
+	}
+	buf = buf[:n]
+
+	switch typ {
+	case syscall.REG_SZ, syscall.REG_EXPAND_SZ:
+		u16 := make([]uint16, len(buf)/2)
+		for i := range u16 {
+			u16[i] = binary.LittleEndian.Uint16(buf[i*2:])
+		}
+		return syscall.UTF16ToString(u16), true, nil
+	case syscall.REG_DWORD:
+		if len(buf) < 4 {
+			return "", false, fmt.Errorf("invalid DWORD value")
+		}
+		return strconv.FormatUint(uint64(binary.LittleEndian.Uint32(buf)), 10), true, nil
+	default:
+		return "", false, fmt.Errorf("unsupported registry value type %d", typ)
+	}
+}
@@ -0,0 +1,247 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema is a compiled JSON Schema for the values of json options.
+// The following keywords are supported: type, enum, const, properties, required,
+// additionalProperties, items, minItems, maxItems, minimum, maximum, minLength,
+// maxLength and pattern. Other keywords are ignored.
+type jsonSchema struct {
+	Type                 interface{}            `json:"type"`
+	Enum                 []interface{}          `json:"enum"`
+	Const                *interface{}           `json:"const"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties"`
+	Items                json.RawMessage        `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+
+	types         []string
+	pattern       *regexp.Regexp
+	noAdditional  bool
+	additionalSch *jsonSchema
+	items         *jsonSchema
+}
+
+// compileSchema parses the given JSON Schema
+func compileSchema(src string) (*jsonSchema, error) {
+	var s jsonSchema
+	if err := json.Unmarshal([]byte(src), &s); err != nil {
+		return nil, fmt.Errorf("invalid json schema: %s", err.Error())
+	}
+	if err := s.compile(); err != nil {
+		return nil, fmt.Errorf("invalid json schema: %s", err.Error())
+	}
+	return &s, nil
+}
+
+func (s *jsonSchema) compile() (err error) {
+	switch ty := s.Type.(type) {
+	case nil:
+	case string:
+		s.types = []string{ty}
+	case []interface{}:
+		for _, t := range ty {
+			str, ok := t.(string)
+			if !ok {
+				return fmt.Errorf("invalid type %#v", t)
+			}
+			s.types = append(s.types, str)
+		}
+	default:
+		return fmt.Errorf("invalid type %#v", ty)
+	}
+
+	if s.Pattern != "" {
+		if s.pattern, err = regexp.Compile(s.Pattern); err != nil {
+			return err
+		}
+	}
+
+	if len(s.AdditionalProperties) > 0 {
+		var allowed bool
+		if string(s.AdditionalProperties) != "null" && json.Unmarshal(s.AdditionalProperties, &allowed) == nil {
+			s.noAdditional = !allowed
+		} else if s.additionalSch, err = compileSubSchema(s.AdditionalProperties); err != nil {
+			return fmt.Errorf("additionalProperties: %s", err.Error())
+		}
+	}
+
+	for name, prop := range s.Properties {
+		if prop == nil {
+			return fmt.Errorf("property %#v: schema is null", name)
+		}
+		if err = prop.compile(); err != nil {
+			return err
+		}
+	}
+
+	if len(s.Items) > 0 {
+		if s.items, err = compileSubSchema(s.Items); err != nil {
+			return fmt.Errorf("items: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// compileSubSchema parses and compiles the schema inside the given raw JSON
+func compileSubSchema(raw json.RawMessage) (*jsonSchema, error) {
+	if string(raw) == "null" {
+		return nil, fmt.Errorf("schema is null")
+	}
+	var s jsonSchema
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, err
+	}
+	if err := s.compile(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// pointerEscaper escapes a property name as reference token of a JSON pointer
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// schemaType returns the JSON Schema type of the unmarshalled value v
+func schemaType(v interface{}) string {
+	switch ty := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if ty == math.Trunc(ty) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return ""
+}
+
+// validate validates the unmarshalled value v which is found at the given path
+func (s *jsonSchema) validate(v interface{}, path string) *schemaViolation {
+	fail := func(format string, args ...interface{}) *schemaViolation {
+		return &schemaViolation{path, fmt.Sprintf(format, args...)}
+	}
+
+	if len(s.types) > 0 {
+		typ := schemaType(v)
+		matches := false
+		for _, t := range s.types {
+			if t == typ || (t == "number" && typ == "integer") {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			return fail("type is %s, expected %v", typ, s.types)
+		}
+	}
+
+	if s.Enum != nil {
+		found := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fail("value %v is not one of %v", v, s.Enum)
+		}
+	}
+
+	if s.Const != nil && !reflect.DeepEqual(*s.Const, v) {
+		return fail("value %v is not %v", v, *s.Const)
+	}
+
+	switch ty := v.(type) {
+	case float64:
+		if s.Minimum != nil && ty < *s.Minimum {
+			return fail("%v is less than the minimum %v", ty, *s.Minimum)
+		}
+		if s.Maximum != nil && ty > *s.Maximum {
+			return fail("%v is greater than the maximum %v", ty, *s.Maximum)
+		}
+	case string:
+		l := utf8.RuneCountInString(ty)
+		if s.MinLength != nil && l < *s.MinLength {
+			return fail("length %d is less than the minimum length %d", l, *s.MinLength)
+		}
+		if s.MaxLength != nil && l > *s.MaxLength {
+			return fail("length %d is greater than the maximum length %d", l, *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(ty) {
+			return fail("%#v does not match the pattern %#v", ty, s.Pattern)
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(ty) < *s.MinItems {
+			return fail("%d items are less than the minimum %d", len(ty), *s.MinItems)
+		}
+		if s.MaxItems != nil && len(ty) > *s.MaxItems {
+			return fail("%d items are more than the maximum %d", len(ty), *s.MaxItems)
+		}
+		if s.items != nil {
+			for i, item := range ty {
+				if err := s.items.validate(item, fmt.Sprintf("%s/%d", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, req := range s.Required {
+			if _, has := ty[req]; !has {
+				return fail("missing required property %#v", req)
+			}
+		}
+		// sorted, to report the same violation every time
+		keys := make([]string, 0, len(ty))
+		for k := range ty {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			prop, has := s.Properties[k]
+			switch {
+			case has:
+			case s.noAdditional:
+				return fail("additional property %#v is not allowed", k)
+			case s.additionalSch != nil:
+				prop = s.additionalSch
+			default:
+				continue
+			}
+			if err := prop.validate(ty[k], path+"/"+pointerEscaper.Replace(k)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// schemaViolation describes the failing path (as JSON pointer) and the reason
+type schemaViolation struct {
+	path    string
+	message string
+}